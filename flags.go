@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin"
+	"github.com/finbourne/uav/pkg/pipeline"
+	"github.com/finbourne/uav/pkg/uav"
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// templateFlags are the flags controlling how a pipeline is rendered, shared
+// by every command which renders one.
+type templateFlags struct {
+	templateDirs *[]string
+	templates    *[]string
+	resolve      *string
+	maxDepth     *int
+	strictKeys   *bool
+	vars         *[]string
+	jsonVars     *[]string
+	varsFiles    *[]string
+	envPrefixes  *[]string
+	allowEnv     *[]string
+	sort         *string
+	groupRules   *[]string
+	allGroup     *string
+	timeout      *time.Duration
+	jobs         *int
+}
+
+// addTemplateFlags registers the template flags on cmd. templates is the
+// argument or flag naming individual template files.
+func addTemplateFlags(cmd *kingpin.CmdClause, templates *[]string) *templateFlags {
+	return &templateFlags{
+		templateDirs: cmd.Flag("directory", "A directory containing additional Go templates to parse and make available to pipelines.").Short('d').ExistingDirs(),
+		templates:    templates,
+		resolve:      cmd.Flag("resolve", "How merge template paths are resolved: 'cwd' (relative to the working directory) or 'relative' (relative to the including file, then the pipeline). Overrides the pipeline's 'uav: {resolve: ...}' setting.").Enum(string(pipeline.ResolveWorkingDir), string(pipeline.ResolveRelative)),
+		maxDepth:     cmd.Flag("max-depth", "The maximum depth merge clauses may be nested to. Zero means no limit.").Default("0").Int(),
+		strictKeys:   cmd.Flag("strict-keys", "Fail on top-level pipeline keys UAV does not understand, rather than warning about them.").Bool(),
+		vars:         cmd.Flag("var", "A key=value argument for the root pipeline template. Overrides --var-json and --vars-file.").PlaceHolder("KEY=VALUE").Strings(),
+		jsonVars:     cmd.Flag("var-json", "A key=<json> argument for the root pipeline template. Overrides --vars-file.").PlaceHolder("KEY=JSON").Strings(),
+		varsFiles:    cmd.Flag("vars-file", "A YAML file of arguments for the root pipeline template. Later files override earlier ones.").PlaceHolder("FILE").Strings(),
+		envPrefixes:  cmd.Flag("env-prefix", "Expose environment variables starting with this prefix to templates as .Env, and restrict the env and expandenv functions to the variables allowed.").PlaceHolder("PREFIX").Strings(),
+		allowEnv:     cmd.Flag("allow-env", "Expose this environment variable to templates as .Env, and restrict the env and expandenv functions to the variables allowed.").PlaceHolder("NAME").Strings(),
+		groupRules:   cmd.Flag("group-rule", "Add the jobs whose names match REGEX to the group NAME.").PlaceHolder("NAME=REGEX").Strings(),
+		allGroup:     cmd.Flag("all-group", "Add a group of this name listing every job.").PlaceHolder("NAME").String(),
+		jobs:         cmd.Flag("jobs", "The number of merge templates to render at once. The output is the same whatever the number.").Default("1").PlaceHolder("N").Int(),
+		timeout:      cmd.Flag("timeout", "Give up rendering the pipeline after this long, e.g. '30s', naming the template being rendered. Zero means no limit.").Default("0").Duration(),
+		sort:         cmd.Flag("sort", "How jobs, resources, resource types, var sources and groups are ordered: 'preserve-first-seen' (in the order they are first merged), 'by-name' or 'by-type-then-name'. By default each template's resources are placed before those merged earlier.").Enum(string(pipeline.SortFirstSeen), string(pipeline.SortByName), string(pipeline.SortByTypeThenName)),
+	}
+}
+
+// options returns the pipeline options selected by the flags.
+func (f *templateFlags) options() ([]pipeline.Option, error) {
+	var rules []pipeline.GroupRule
+	for _, r := range *f.groupRules {
+		rule, err := pipeline.ParseGroupRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("--group-rule %q: %v", r, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return []pipeline.Option{
+		pipeline.WithResolution(pipeline.Resolution(*f.resolve)),
+		pipeline.WithMaxMergeDepth(*f.maxDepth),
+		pipeline.WithStrictKeys(*f.strictKeys),
+		pipeline.WithEnv(*f.envPrefixes, *f.allowEnv),
+		pipeline.WithSortOrder(pipeline.SortOrder(*f.sort)),
+		pipeline.WithGroupRules(rules...),
+		pipeline.WithAllGroup(*f.allGroup),
+		pipeline.WithJobs(*f.jobs),
+	}, nil
+}
+
+// render reads pipelineFile and transforms it with the options selected by
+// the flags and opts, writing any warnings to stderr.
+func (f *templateFlags) render(pipelineFile string, opts ...pipeline.Option) (*pipeline.Pipeline, error) {
+	args, err := loadVars(*f.varsFiles, *f.jsonVars, *f.vars)
+	if err != nil {
+		return nil, err
+	}
+	flagOpts, err := f.options()
+	if err != nil {
+		return nil, err
+	}
+
+	r := uav.NewRenderer(
+		uav.WithTemplates(*f.templates...),
+		uav.WithTemplateDirs(*f.templateDirs...),
+		uav.WithVars(args),
+		uav.WithPipelineOptions(flagOpts...),
+	)
+	ctx := context.Background()
+	if *f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *f.timeout)
+		defer cancel()
+	}
+	pl, err := r.RenderFileContext(ctx, pipelineFile, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, warning := range pl.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	return pl, nil
+}
+
+// renderFlags are the flags of the commands which render a single pipeline.
+type renderFlags struct {
+	pipelineFile **os.File
+	*templateFlags
+}
+
+func addRenderFlags(cmd *kingpin.CmdClause) *renderFlags {
+	return &renderFlags{
+		pipelineFile:  cmd.Flag("pipeline", "Name of file containing the pipeline to process.").Required().Short('p').File(),
+		templateFlags: addTemplateFlags(cmd, cmd.Arg("template", "An additional Go template to parse and make available to pipelines.").ExistingFiles()),
+	}
+}
+
+// render reads the pipeline file and transforms it.
+func (f *renderFlags) render(opts ...pipeline.Option) (*pipeline.Pipeline, error) {
+	return f.templateFlags.render((*f.pipelineFile).Name(), opts...)
+}
+
+// diffFlags are the flags of the diff command, which renders two pipelines
+// with the same template flags.
+type diffFlags struct {
+	from         *string
+	to           *string
+	fromRendered *bool
+	toRendered   *bool
+	*templateFlags
+}
+
+func addDiffFlags(cmd *kingpin.CmdClause) *diffFlags {
+	return &diffFlags{
+		from:          cmd.Arg("old", "The pipeline to compare from.").Required().ExistingFile(),
+		to:            cmd.Arg("new", "The pipeline to compare to.").Required().ExistingFile(),
+		fromRendered:  cmd.Flag("old-rendered", "The old pipeline is already rendered YAML, e.g. the output of a previous merge, and is read as it is.").Bool(),
+		toRendered:    cmd.Flag("new-rendered", "The new pipeline is already rendered YAML, and is read as it is.").Bool(),
+		templateFlags: addTemplateFlags(cmd, cmd.Flag("template", "An additional Go template to parse and make available to pipelines.").Short('t').ExistingFiles()),
+	}
+}
+
+// diff renders both pipelines and compares them.
+func (f *diffFlags) diff() ([]pipeline.Difference, error) {
+	from, err := f.load(*f.from, *f.fromRendered)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", *f.from, err)
+	}
+	to, err := f.load(*f.to, *f.toRendered)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", *f.to, err)
+	}
+
+	return pipeline.Diff(from, to), nil
+}
+
+func (f *diffFlags) load(file string, rendered bool) (*pipeline.Pipeline, error) {
+	if !rendered {
+		return f.templateFlags.render(file)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var pl pipeline.Pipeline
+	if err := yaml.Unmarshal(data, &pl); err != nil {
+		return nil, err
+	}
+	return &pl, nil
+}
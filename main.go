@@ -2,9 +2,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"strings"
 
 	"github.com/finbourne/uav/pkg/log"
 	"github.com/finbourne/uav/pkg/pipeline"
@@ -12,16 +15,40 @@ import (
 )
 
 var (
-	app          = kingpin.New("uav", "A commandline app for composing Concourse-CI pipelines.")
-	merge        = app.Command("merge", "Take the pipeline and merge all the templates into it.")
-	pipelineFile = merge.Flag("pipeline", "Name of file containing the pipeline to process.").Required().Short('p').File()
-	templateDirs = merge.Flag("directory", "A directory containing additional Go templates to parse and make available to pipelines.").Short('d').ExistingDirs()
-	templates    = merge.Arg("template", "An additional Go template to parse and make available to pipelines.").ExistingFiles()
-	verbose      = app.Flag("verbose", "Verbose output.").Short('v').Bool()
-	jsonVerbose  = app.Flag("json", "Verbose output in JSON format - use in combination with '--verbose'.").Short('j').Bool()
-
+	app        = kingpin.New("uav", "A commandline app for composing Concourse-CI pipelines.")
+	merge      = app.Command("merge", "Take the pipeline and merge all the templates into it.")
+	mergeFlags = addRenderFlags(merge)
 	outputFile = merge.Flag("output", "The file to save the output to.").Short('o').String()
-	version    = "development"
+	validateOn = merge.Flag("validate", "Check the merged pipeline for dangling references before writing it.").Bool()
+	prune      = merge.Flag("prune", "Remove resources no job uses and resource types no remaining resource or task uses, reporting each on stderr.").Bool()
+	failUnused = merge.Flag("fail-on-unused", "Fail, without writing the pipeline, if it has resources no job uses or resource types no resource or task uses.").Bool()
+	provenance = merge.Flag("provenance", "Record the template and merge chain which introduced each object and plan step: 'comments' (as YAML comments in the output) or 'json' (in a JSON file alongside the output).").Enum("comments", "json")
+	provFile   = merge.Flag("provenance-file", "The file to save JSON provenance to. Defaults to the output file with '.provenance.json' appended.").String()
+
+	validate      = app.Command("validate", "Merge the pipeline and report every reference to an undeclared resource, resource type or job.")
+	validateFlags = addRenderFlags(validate)
+
+	watch         = app.Command("watch", "Merge the pipeline, then merge it again each time the pipeline, a template or a file it merges changes.")
+	watchFlags    = addRenderFlags(watch)
+	watchOutput   = watch.Flag("output", "The file to save the output to.").Short('o').String()
+	watchInterval = watch.Flag("interval", "How often to check the files for changes.").Default("500ms").Duration()
+	watchDebounce = watch.Flag("debounce", "How long the files must be unchanged for before merging again.").Default("200ms").Duration()
+
+	graph       = app.Command("graph", "Merge the pipeline and write the dependency graph of its jobs and resources, derived from get and put steps and passed constraints.")
+	graphFlags  = addRenderFlags(graph)
+	graphFormat = graph.Flag("format", "The graph format: 'dot' (Graphviz), 'mermaid' or 'json'.").Short('f').Default("dot").Enum("dot", "mermaid", "json")
+	graphOutput = graph.Flag("output", "The file to save the graph to.").Short('o').String()
+
+	explain      = app.Command("explain", "Merge the pipeline and print the tree of merge entries processed: where each template was found, the args passed, and the objects it added, deduplicated or resolved.")
+	explainFlags = addRenderFlags(explain)
+
+	diff          = app.Command("diff", "Render two pipelines and report the jobs, resources, resource types and groups added, removed or changed between them. Exits with status 1 if there are any differences, and 2 if a pipeline cannot be rendered.")
+	diffArguments = addDiffFlags(diff)
+
+	verbose     = app.Flag("verbose", "Verbose output.").Short('v').Bool()
+	jsonVerbose = app.Flag("json", "Verbose output in JSON format - use in combination with '--verbose'. Pipeline errors and validation results are also reported as JSON.").Short('j').Bool()
+
+	version = "development"
 )
 
 func main() {
@@ -40,94 +67,243 @@ func main() {
 
 	switch command {
 	case merge.FullCommand():
-		pipeline, err := os.ReadFile((*pipelineFile).Name())
-		if err != nil {
-			log.Fatalf("Error reading pipeline file: %v", err)
+		sidecar, err := provenanceFile(*outputFile, *provFile)
+		if *provenance == "json" && err != nil {
+			log.Fatalf("Error: %v", err)
 		}
 
-		output, err := performMerge(string(pipeline), *templates, *templateDirs)
+		pl, err := mergeFlags.render()
 		if err != nil {
-			log.Fatalf("Error creating new pipeline: %v", err)
+			fatalPipelineError("Error creating new pipeline", err)
 		}
 
-		if *outputFile == "-" || *outputFile == "" {
-			_, err = os.Stdout.WriteString(output)
+		if *validateOn {
+			if problems := pl.Validate(); len(problems) > 0 {
+				reportValidation(os.Stderr, problems)
+				os.Exit(1)
+			}
+		}
+
+		if *failUnused {
+			if unused := pl.Unused(); len(unused) > 0 {
+				reportValidation(os.Stderr, unused)
+				os.Exit(1)
+			}
+		}
+		if *prune {
+			reportPruned(os.Stderr, pl.Prune())
+		}
+
+		var output string
+		if *provenance == "comments" {
+			output, err = pl.MarshalWithProvenance()
 		} else {
-			err = os.WriteFile(*outputFile, []byte(output), 0644)
+			output, err = pl.Marshal()
+		}
+		if err != nil {
+			log.Fatalf("Error marshalling pipeline: %v", err)
+		}
+
+		if err := writeOutput(*outputFile, output); err != nil {
+			log.Fatalf("Error writing output: %v", err)
+		}
+
+		if *provenance == "json" {
+			if err := writeProvenance(pl, sidecar); err != nil {
+				log.Fatalf("Error writing provenance: %v", err)
+			}
+		}
+
+	case validate.FullCommand():
+		pl, err := validateFlags.render()
+		if err != nil {
+			fatalPipelineError("Error creating new pipeline", err)
+		}
+
+		problems := pl.Validate()
+		reportValidation(os.Stdout, problems)
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+
+	case watch.FullCommand():
+		watchPipeline(watchFlags, *watchOutput, *watchInterval, *watchDebounce)
+
+	case graph.FullCommand():
+		pl, err := graphFlags.render()
+		if err != nil {
+			fatalPipelineError("Error creating new pipeline", err)
 		}
 
+		output, err := formatGraph(pl.Graph(), *graphFormat)
 		if err != nil {
+			log.Fatalf("Error formatting graph: %v", err)
+		}
+		if err := writeOutput(*graphOutput, output); err != nil {
 			log.Fatalf("Error writing output: %v", err)
 		}
 
+	case explain.FullCommand():
+		trace := &pipeline.Trace{}
+		_, err := explainFlags.render(pipeline.WithTrace(trace))
+		reportTrace(os.Stdout, trace)
+		if err != nil {
+			fatalPipelineError("Error creating new pipeline", err)
+		}
+
+	case diff.FullCommand():
+		differences, err := diffArguments.diff()
+		if err != nil {
+			reportPipelineError("Error rendering pipeline", err)
+			os.Exit(diffStatusTrouble)
+		}
+
+		reportDiff(os.Stdout, differences)
+		if len(differences) > 0 {
+			os.Exit(diffStatusDifferent)
+		}
+
 	default:
 		os.Exit(1)
 	}
 }
 
-func performMerge(inputPipeline string, templates []string, templateDirs []string) (string, error) {
-	var err error
-
-	if len(templateDirs) > 0 {
-		//If the user has specified directories containing template files,
-		//these are combined with the template files individually specified (if any)
-		templates, err = combineTemplates(templates, templateDirs)
-		if err != nil {
-			return "", fmt.Errorf("combining template files and template directories: %v", err)
-		}
+// writeOutput writes output to file, or to stdout if file is "-" or empty.
+func writeOutput(file string, output string) error {
+	if file == "-" || file == "" {
+		_, err := os.Stdout.WriteString(output)
+		return err
 	}
+	return os.WriteFile(file, []byte(output), 0644)
+}
 
-	pl, err := pipeline.NewPipeline(inputPipeline, nil, templates)
-	if err != nil {
-		return "", fmt.Errorf("transforming pipeline file: %v", err)
+// provenanceFile returns the file JSON provenance is written to: file if
+// set, otherwise one alongside output.
+func provenanceFile(output string, file string) (string, error) {
+	if file != "" {
+		return file, nil
+	}
+	if output == "" || output == "-" {
+		return "", errors.New("--provenance-file is required when the output is stdout")
 	}
+	return output + ".provenance.json", nil
+}
 
-	pl, err = pl.Transform()
+// writeProvenance writes the provenance of pl to file as JSON.
+func writeProvenance(pl *pipeline.Pipeline, file string) error {
+	data, err := json.MarshalIndent(pl.Provenance(), "", "  ")
 	if err != nil {
-		return "", err
+		return err
 	}
+	return writeOutput(file, string(data)+"\n")
+}
 
-	return pl.String(), nil
+// formatGraph renders g in the named format.
+func formatGraph(g *pipeline.Graph, format string) (string, error) {
+	switch format {
+	case "mermaid":
+		return g.Mermaid(), nil
+	case "json":
+		data, err := json.MarshalIndent(g, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	}
+	return g.DOT(), nil
 }
 
-// combineTemplates returns a slice which is the superset of the templates slice and the file paths of
-// all files contained in directories rooted at the directories specified in the templateDirs slice
-func combineTemplates(templates []string, templateDirs []string) ([]string, error) {
-	directoryTemplates, err := getDirectoryTemplates(templateDirs)
-	if err != nil {
-		return nil, err
+// reportValidation writes each validation problem on its own line, or as a
+// JSON array when `--json` is set.
+func reportValidation(w io.Writer, problems []pipeline.ValidationError) {
+	if *jsonVerbose {
+		if problems == nil {
+			problems = []pipeline.ValidationError{}
+		}
+		data, err := json.Marshal(problems)
+		if err != nil {
+			log.Fatalf("Error marshalling validation results: %v", err)
+		}
+		fmt.Fprintln(w, string(data))
+		return
 	}
 
-	return append(templates, directoryTemplates...), nil
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem.Error())
+	}
 }
 
-// getDirectoryTemplates recurses through the directory tree rooted at each element of slice templateDirs
-// and adds each file path to the returned slice
-func getDirectoryTemplates(templateDirs []string) ([]string, error) {
-	// At this point, kingpin has already ensured that the templateDirs are
-	// actually directories and not any other kind of file
-
-	var templateFiles []string
+// Exit statuses of the diff command, which follow diff(1) so that CI can tell
+// a changed pipeline from one which failed to render.
+const (
+	diffStatusDifferent = 1
+	diffStatusTrouble   = 2
+)
 
-	// Callback function called when each directory entry is visited by the walker
-	walkFunc := func(currentPath string, info os.FileInfo, err error) error {
+// reportDiff writes each difference on its own line, or as a JSON array when
+// `--json` is set.
+func reportDiff(w io.Writer, differences []pipeline.Difference) {
+	if *jsonVerbose {
+		if differences == nil {
+			differences = []pipeline.Difference{}
+		}
+		data, err := json.Marshal(differences)
 		if err != nil {
-			return fmt.Errorf("reading file %s: %v", currentPath, err)
+			log.Fatalf("Error marshalling differences: %v", err)
 		}
+		fmt.Fprintln(w, string(data))
+		return
+	}
 
-		if !info.IsDir() {
-			templateFiles = append(templateFiles, currentPath)
-		}
+	for _, d := range differences {
+		fmt.Fprintln(w, d.String())
+	}
+}
+
+// reportPruned writes the objects removed by pruning to w.
+func reportPruned(w io.Writer, removed []pipeline.ValidationError) {
+	if *jsonVerbose {
+		reportValidation(w, removed)
+		return
+	}
 
-		return nil
+	for _, r := range removed {
+		fmt.Fprintf(w, "pruned %s %s from %s: %s\n", strings.Replace(r.Kind, "_", " ", -1), r.Name, r.Template(), r.Message)
 	}
+}
 
-	for _, templateDir := range templateDirs {
-		err := filepath.Walk(templateDir, walkFunc)
+// reportTrace writes the merge trace to w, as JSON if --json is set.
+func reportTrace(w io.Writer, trace *pipeline.Trace) {
+	if *jsonVerbose {
+		data, err := json.MarshalIndent(trace.Root, "", "  ")
 		if err != nil {
-			return nil, fmt.Errorf("recursing directory tree rooted at %s: %v", templateDir, err)
+			log.Fatalf("Error marshalling trace: %v", err)
+		}
+		fmt.Fprintln(w, string(data))
+		return
+	}
+
+	fmt.Fprint(w, trace.String())
+}
+
+// fatalPipelineError reports err and exits. Pipeline errors are written as a
+// JSON document when `--json` is set so that tooling can locate the failure.
+func fatalPipelineError(context string, err error) {
+	reportPipelineError(context, err)
+	os.Exit(1)
+}
+
+// reportPipelineError reports err as fatalPipelineError does, without
+// exiting.
+func reportPipelineError(context string, err error) {
+	var pe *pipeline.PipelineError
+	if *jsonVerbose && errors.As(err, &pe) {
+		data, jsonErr := json.Marshal(pe)
+		if jsonErr == nil {
+			fmt.Fprintln(os.Stderr, string(data))
+			return
 		}
 	}
 
-	return templateFiles, nil
+	log.Errorf("%s: %v", context, err)
 }
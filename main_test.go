@@ -4,7 +4,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin"
 )
 
 const (
@@ -16,30 +21,30 @@ const (
 `
 	expectedOutput = `resources:
 - name: test
+  type: git
   source:
+    uri: git@github.com:concourse/concourse.git
     branch: master
     private_key: ((github.privatekey))
-    uri: git@github.com:concourse/concourse.git
-  type: git
 jobs:
 - name: deploy-qa
+  serial: true
   plan:
   - get: repo
-  - config:
+  - task: task1
+    config:
+      platform: linux
       image_resource:
+        type: docker-image
         source:
           repository: test/docker-container
-        type: docker-image
-      platform: linux
       run:
+        path: /bin/bash
         args:
         - -cel
         - |
           cd repo
           echo Hello qa!
-        path: /bin/bash
-    task: task1
-  serial: true
 `
 )
 
@@ -103,7 +108,8 @@ func TestPerformMerge(t *testing.T) {
 // getYamlMap. uav is run from testdata/ (not chdir-ed into nested_dir/), so
 // the pipeline's `- template: jobs/test.yml` and the nested
 // `- template: jobs/resources/repo.yml` cannot resolve from disk — both must
-// come from the template index built out of `-d nested_dir/jobs`, keyed by
+// come from the template index built out of `-d nested_dir/jobs`, the first
+// by the name the directory gives the files at its top and the second by
 // basename.
 func TestMergeBasenameFallback(t *testing.T) {
 	if _, err := os.Stat("nested_dir/jobs"); err != nil {
@@ -112,9 +118,9 @@ func TestMergeBasenameFallback(t *testing.T) {
 		}
 	}
 
-	output, err := performMerge(input, nil, []string{"nested_dir/jobs"})
+	output, err := mergeWithFlags(t, input, "-d", "nested_dir/jobs")
 	if err != nil {
-		t.Fatalf("performMerge error: %v", err)
+		t.Fatalf("merge error: %v", err)
 	}
 
 	if output != expectedOutput {
@@ -122,6 +128,29 @@ func TestMergeBasenameFallback(t *testing.T) {
 	}
 }
 
+// mergeWithFlags renders pipeline as `uav merge` does, from a pipeline file
+// and the command line args which follow `-p`.
+func mergeWithFlags(t *testing.T, pipeline string, args ...string) (string, error) {
+	file := filepath.Join(t.TempDir(), "pipeline.yml")
+	if err := os.WriteFile(file, []byte(pipeline), 0644); err != nil {
+		t.Fatalf("Unable to write pipeline file: %v", err)
+	}
+
+	app := kingpin.New("uav", "")
+	cmd := app.Command("merge", "")
+	flags := addRenderFlags(cmd)
+	if _, err := app.Parse(append([]string{"merge", "-p", file}, args...)); err != nil {
+		return "", err
+	}
+	defer (*flags.pipelineFile).Close()
+
+	pl, err := flags.render()
+	if err != nil {
+		return "", err
+	}
+	return pl.Marshal()
+}
+
 func doTest(t *testing.T, test *testCase) {
 	err := os.Chdir(test.workingDir)
 	if err != nil {
@@ -134,7 +163,11 @@ func doTest(t *testing.T, test *testCase) {
 	currentWorkingDir, _ := os.Getwd()
 	log.Printf("Running test [%v] in directory [%v]", test, currentWorkingDir)
 
-	output, err := performMerge(input, test.files, test.dirs)
+	args := append([]string{}, test.files...)
+	for _, dir := range test.dirs {
+		args = append(args, "-d", dir)
+	}
+	output, err := mergeWithFlags(t, input, args...)
 	if err != nil {
 		t.Errorf("Error encountered for %v: %v", test, err)
 		return
@@ -168,3 +201,83 @@ func writeIncorrectOutputFile(output string, test *testCase) {
 		log.Printf("Unable to create incorrect_output file for %v: %v", test, err)
 	}
 }
+
+func TestLoadVars(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yml")
+	override := filepath.Join(dir, "override.yml")
+	os.WriteFile(base, []byte("env: ci\nregion: eu\n"), 0644)
+	os.WriteFile(override, []byte("env: qa\n"), 0644)
+
+	args, err := loadVars(
+		[]string{base, override},
+		[]string{`envs=["ci", "qa"]`},
+		[]string{"region=us", "url=https://example.com/?a=b"},
+	)
+	if err != nil {
+		t.Fatalf("loadVars error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"env":    "qa",
+		"region": "us",
+		"envs":   []interface{}{"ci", "qa"},
+		"url":    "https://example.com/?a=b",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	for _, bad := range []struct {
+		files    []string
+		jsonVars []string
+		vars     []string
+	}{
+		{vars: []string{"novalue"}},
+		{vars: []string{"=value"}},
+		{jsonVars: []string{"envs=[ci"}},
+		{files: []string{filepath.Join(dir, "missing.yml")}},
+	} {
+		if _, err := loadVars(bad.files, bad.jsonVars, bad.vars); err == nil {
+			t.Errorf("Expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestWatcherRendersOnChange(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "pipeline.yml")
+	os.WriteFile(file, []byte("jobs: []\n"), 0644)
+
+	renders := make(chan error, 10)
+	w := &watcher{
+		interval: 5 * time.Millisecond,
+		debounce: 20 * time.Millisecond,
+		render: func() ([]string, error) {
+			return []string{file}, nil
+		},
+		report: func(err error) {
+			renders <- err
+		},
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.run(stop)
+
+	<-renders
+	// Two writes within the debounce period cause a single render.
+	os.WriteFile(file, []byte("jobs:\n- name: a\n"), 0644)
+	os.WriteFile(file, []byte("jobs:\n- name: a\n- name: b\n"), 0644)
+
+	select {
+	case <-renders:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a render after the file changed")
+	}
+	select {
+	case <-renders:
+		t.Errorf("Expected changes within the debounce period to cause a single render")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
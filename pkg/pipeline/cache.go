@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"sync"
+	"text/template"
+)
+
+// templateCache holds the work shared by every render of one pipeline, so
+// that a pipeline with many `merge:` entries reads and parses each template
+// file once however often it is used.
+type templateCache struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	rendered map[renderKey]string
+
+	parseOnce sync.Once
+	parsed    *template.Template
+	parseErr  error
+}
+
+// renderKey identifies the output of the template read from path rendered
+// with the given arguments, compared by their JSON encoding.
+type renderKey struct {
+	path string
+	args string
+}
+
+// newRenderKey returns the key for rendering path with params, or false if
+// params cannot be compared, in which case the output is not memoised.
+func newRenderKey(path string, params interface{}) (renderKey, bool) {
+	args, err := json.Marshal(params)
+	if err != nil {
+		return renderKey{}, false
+	}
+	return renderKey{path: path, args: string(args)}, true
+}
+
+// read returns the content of the named file in fsys, reading it only the
+// first time it is asked for. Failed reads are not remembered.
+func (i *templateIndex) read(fsys fs.FS, name string) ([]byte, error) {
+	if i == nil {
+		return readFile(fsys, name)
+	}
+
+	i.cache.mu.Lock()
+	data, ok := i.cache.files[name]
+	i.cache.mu.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	data, err := readFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	i.cache.mu.Lock()
+	if i.cache.files == nil {
+		i.cache.files = map[string][]byte{}
+	}
+	i.cache.files[name] = data
+	i.cache.mu.Unlock()
+	return data, nil
+}
+
+// templates returns a template set named "pipeline" holding the indexed
+// templates, for a single render which gives up once ctx is done. The
+// templates are parsed the first time only; later calls clone that set, so
+// that whatever the rendered text defines stays private to its render, and
+// bind the funcs afresh so that `include` and `exists` look up templates in
+// the clone and `include` sees ctx.
+func (i *templateIndex) templates(ctx context.Context, o *options) (*template.Template, error) {
+	if i == nil {
+		t := template.New("pipeline")
+		return t.Funcs(funcMap(ctx, t, i, o)), nil
+	}
+
+	i.cache.parseOnce.Do(func() {
+		t := template.New("pipeline")
+		t = t.Funcs(funcMap(context.Background(), t, i, o))
+		i.cache.parseErr = i.parseInto(t)
+		i.cache.parsed = t
+	})
+	if i.cache.parseErr != nil {
+		return nil, i.cache.parseErr
+	}
+
+	t, err := i.cache.parsed.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return t.Funcs(funcMap(ctx, t, i, o)), nil
+}
+
+// output returns the memoised output of rendering k, if any.
+func (i *templateIndex) output(k renderKey) (string, bool) {
+	if i == nil {
+		return "", false
+	}
+	i.cache.mu.Lock()
+	defer i.cache.mu.Unlock()
+	out, ok := i.cache.rendered[k]
+	return out, ok
+}
+
+// memoise records out as the output of rendering k.
+func (i *templateIndex) memoise(k renderKey, out string) {
+	if i == nil {
+		return
+	}
+	i.cache.mu.Lock()
+	defer i.cache.mu.Unlock()
+	if i.cache.rendered == nil {
+		i.cache.rendered = map[renderKey]string{}
+	}
+	i.cache.rendered[k] = out
+}
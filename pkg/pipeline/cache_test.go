@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"text/template"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// countingFS counts the files opened from a MapFS.
+type countingFS struct {
+	fstest.MapFS
+	opened map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.opened[name]++
+	return c.MapFS.Open(name)
+}
+
+func TestTransformCachesTemplates(t *testing.T) {
+	fsys := &countingFS{
+		MapFS: fstest.MapFS{
+			"job.yml": {Data: []byte(`
+jobs:
+- name: {{ .name }}
+  plan:
+  - task: {{ count }}
+    file: {{ include "task.tpl" . }}
+`)},
+			"task.tpl": {Data: []byte(`ci/{{ .name }}.yml`)},
+		},
+		opened: map[string]int{},
+	}
+	p := `
+merge:
+- template: job.yml
+  args:
+    name: build
+- template: job.yml
+  args:
+    name: test
+- template: job.yml
+  args:
+    name: build
+`
+	expectedPipeline := `
+jobs:
+- name: build
+  plan:
+  - task: 1
+    file: ci/build.yml
+- name: test
+  plan:
+  - task: 2
+    file: ci/test.yml
+`
+	pipeline := new(Pipeline)
+	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
+	expected := pipeline.String()
+
+	renders := 0
+	count := func() int {
+		renders++
+		return renders
+	}
+	merger, err := NewPipeline(p, nil, []string{"job.yml", "task.tpl"},
+		WithFS(fsys), WithFuncs(template.FuncMap{"count": count}))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err = merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	if result := pipeline.String(); result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+	if renders != 2 {
+		t.Errorf("Expected job.yml to be rendered once per set of args, got %d renders", renders)
+	}
+	for name, n := range fsys.opened {
+		if n != 1 {
+			t.Errorf("Expected %s to be read once, read %d times", name, n)
+		}
+	}
+}
+
+func TestTransformDefinesArePrivate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.yml": {Data: []byte(`{{ define "label" }}a{{ end }}
+jobs:
+- name: {{ template "label" }}
+  plan: []
+`)},
+		"b.yml": {Data: []byte(`
+jobs:
+- name: b-{{ exists "label" }}
+  plan: []
+`)},
+	}
+	p := `
+merge:
+- template: a.yml
+- template: b.yml
+`
+	merger, err := NewPipeline(p, nil, nil, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	var names []string
+	for _, job := range pipeline.Jobs {
+		name, _ := scalarValue(mappingValue(job, "name"))
+		names = append(names, name)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b-false" {
+		t.Errorf("Expected a's define to be invisible to b, got jobs %v", names)
+	}
+}
@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"text/template"
+)
+
+// execute applies t to data, writing the output to w, as t.Execute does, but
+// gives up once ctx is done. The error wraps ctx.Err(), e.g.
+// context.DeadlineExceeded.
+//
+// text/template cannot be interrupted, so the template is executed on its own
+// goroutine. One which is still writing output, including the output of
+// templates it includes, fails at its next write, and one calling `include`,
+// `until`, `untilStep` or a function set with WithFuncs fails at its
+// next call. A loop which does none of these, e.g. ranging over a list it was
+// given, runs on in the background until it finishes.
+func execute(ctx context.Context, t *template.Template, w io.Writer, data interface{}) error {
+	if ctx.Done() == nil {
+		return t.Execute(w, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return stopped(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- t.Execute(&contextWriter{ctx: ctx, w: w}, data)
+	}()
+
+	select {
+	case err := <-done:
+		if ctx.Err() != nil && err != nil {
+			return stopped(ctx.Err())
+		}
+		return err
+	case <-ctx.Done():
+		return stopped(ctx.Err())
+	}
+}
+
+func stopped(err error) error {
+	return fmt.Errorf("rendering stopped: %w", err)
+}
+
+// contextWriter fails writes once ctx is done, so that a template still
+// producing output stops at the next write.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// stoppable wraps the template function fn so that calls to it fail once ctx
+// is done, stopping a loop which calls it. It returns the error if fn can,
+// and otherwise panics with it, which text/template returns as the error of
+// the call.
+func stoppable(ctx context.Context, fn interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	if ctx.Done() == nil || v.Kind() != reflect.Func {
+		return fn
+	}
+
+	t := v.Type()
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		err := ctx.Err()
+		if err == nil {
+			if t.IsVariadic() {
+				return v.CallSlice(args)
+			}
+			return v.Call(args)
+		}
+
+		err = stopped(err)
+		if t.NumOut() == 0 || t.Out(t.NumOut()-1) != reflect.TypeOf((*error)(nil)).Elem() {
+			panic(err)
+		}
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		out[len(out)-1] = reflect.ValueOf(&err).Elem()
+		return out
+	}).Interface()
+}
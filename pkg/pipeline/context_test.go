@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"text/template"
+	"time"
+)
+
+func TestTransformContextTimeout(t *testing.T) {
+	fsys := fstest.MapFS{
+		"slow.yml": {Data: []byte(`{{ range until 100000 }}{{ range until 100000 }}#{{ end }}{{ end }}`)},
+	}
+	p := `
+merge:
+- template: slow.yml
+`
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	merger, err := NewPipelineContext(ctx, p, nil, nil, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	_, err = merger.TransformContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+	var pe *PipelineError
+	if !errors.As(err, &pe) || pe.File != "slow.yml" {
+		t.Errorf("Expected the error to name slow.yml, got %v", err)
+	}
+}
+
+func TestTransformContextCancelled(t *testing.T) {
+	fsys := fstest.MapFS{
+		"job.yml": {Data: []byte("jobs:\n- name: build\n  plan: []\n")},
+	}
+	p := `
+merge:
+- template: job.yml
+`
+	merger, err := NewPipeline(p, nil, nil, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = merger.TransformContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected rendering to be cancelled, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "job.yml") {
+		t.Errorf("Expected the error to name job.yml, got %v", err)
+	}
+}
+
+func TestTransformContextTimeoutInInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"job.yml":  {Data: []byte(`jobs:\n- name: {{ include "slow.tpl" . }}\n  plan: []\n`)},
+		"slow.tpl": {Data: []byte(`{{ range until 100000 }}{{ range until 100000 }}{{ tick }}{{ end }}{{ end }}`)},
+	}
+	p := `
+merge:
+- template: job.yml
+`
+	var ticks int64
+	tick := func() string {
+		atomic.AddInt64(&ticks, 1)
+		return "#"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	merger, err := NewPipelineContext(ctx, p, nil, []string{"slow.tpl"}, WithFS(fsys), WithFuncs(template.FuncMap{"tick": tick}))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	_, err = merger.TransformContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+	var pe *PipelineError
+	if !errors.As(err, &pe) || pe.File != "job.yml" {
+		t.Errorf("Expected the error to name job.yml, got %v", err)
+	}
+
+	// The included template stops at its next write, rather than running on
+	// in the background.
+	time.Sleep(50 * time.Millisecond)
+	stoppedAt := atomic.LoadInt64(&ticks)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&ticks); n != stoppedAt {
+		t.Errorf("Expected the included template to stop, but it ran on for %d more iterations", n-stoppedAt)
+	}
+}
+
+func TestTransformContextTimeoutWithoutOutput(t *testing.T) {
+	var ticks int64
+	funcs := template.FuncMap{
+		"tick": func() string {
+			atomic.AddInt64(&ticks, 1)
+			return ""
+		},
+		"tock": func() (string, error) {
+			atomic.AddInt64(&ticks, 1)
+			return "", nil
+		},
+	}
+	tests := []string{
+		`{{ range until 100000 }}{{ range until 100000 }}{{ $x := tick }}{{ end }}{{ end }}`,
+		`{{ range until 100000 }}{{ range until 100000 }}{{ $x := tock }}{{ end }}{{ end }}`,
+	}
+
+	for _, tmpl := range tests {
+		fsys := fstest.MapFS{"loop.yml": {Data: []byte(tmpl)}}
+		p := `
+merge:
+- template: loop.yml
+`
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		merger, err := NewPipelineContext(ctx, p, nil, nil, WithFS(fsys), WithFuncs(funcs))
+		if err != nil {
+			cancel()
+			t.Fatalf("Error creating pipeline: %v", err)
+		}
+		_, err = merger.TransformContext(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the deadline to be exceeded for %q, got %v", tmpl, err)
+			continue
+		}
+
+		// The loop stops at its next call, rather than running on in the
+		// background.
+		time.Sleep(50 * time.Millisecond)
+		stoppedAt := atomic.LoadInt64(&ticks)
+		time.Sleep(50 * time.Millisecond)
+		if n := atomic.LoadInt64(&ticks); n != stoppedAt {
+			t.Errorf("Expected the loop in %q to stop, but it ran on for %d more iterations", tmpl, n-stoppedAt)
+		}
+	}
+}
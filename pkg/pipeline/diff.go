@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// Changes reported by Diff.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// Difference is one semantic difference between two pipelines found by Diff.
+// Kind and Name identify the object, or Kind alone for `display`. Path is
+// empty when the whole object was added or removed, and otherwise locates the
+// field within it, e.g. `plan[1].config.platform`. Old and New hold the
+// values on either side, where present.
+type Difference struct {
+	Kind   string      `json:"kind"`
+	Name   string      `json:"name,omitempty"`
+	Change string      `json:"change"`
+	Path   string      `json:"path,omitempty"`
+	Old    interface{} `json:"old,omitempty"`
+	New    interface{} `json:"new,omitempty"`
+}
+
+func (d Difference) String() string {
+	object := strings.Replace(d.Kind, "_", " ", -1)
+	if d.Name != "" {
+		object = fmt.Sprintf("%s %s", object, d.Name)
+	}
+	if d.Path == "" {
+		return fmt.Sprintf("%s: %s", object, d.Change)
+	}
+
+	switch d.Change {
+	case ChangeAdded:
+		return fmt.Sprintf("%s: %s added: %s", object, d.Path, diffValue(d.New))
+	case ChangeRemoved:
+		return fmt.Sprintf("%s: %s removed: %s", object, d.Path, diffValue(d.Old))
+	}
+	return fmt.Sprintf("%s: %s changed: %s -> %s", object, d.Path, diffValue(d.Old), diffValue(d.New))
+}
+
+func diffValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// Diff compares two transformed pipelines by object identity rather than by
+// text. Groups, var sources, resources, resource types and jobs are matched
+// by name and reported as added, removed or, field by field, changed.
+// Differences in key order, comments and formatting are ignored.
+func Diff(from *Pipeline, to *Pipeline) []Difference {
+	var diffs []Difference
+
+	lists := []struct {
+		kind     string
+		from, to []*yaml.Node
+	}{
+		{kindGroup, from.Groups, to.Groups},
+		{kindVarSource, from.VarSources, to.VarSources},
+		{kindResource, from.Resources, to.Resources},
+		{kindResourceType, from.ResourceTypes, to.ResourceTypes},
+		{kindJob, from.Jobs, to.Jobs},
+	}
+	for _, l := range lists {
+		diffs = append(diffs, diffNamed(l.kind, l.from, l.to)...)
+	}
+
+	switch {
+	case isNull(from.Display) && isNull(to.Display):
+	case isNull(from.Display):
+		diffs = append(diffs, Difference{Kind: kindDisplay, Change: ChangeAdded, New: nodeValue(to.Display)})
+	case isNull(to.Display):
+		diffs = append(diffs, Difference{Kind: kindDisplay, Change: ChangeRemoved, Old: nodeValue(from.Display)})
+	default:
+		diffs = append(diffs, diffNodes(kindDisplay, "", "", from.Display, to.Display)...)
+	}
+
+	return diffs
+}
+
+// diffNamed compares two lists of named objects: those removed or changed in
+// from's order, then those added in to's order.
+func diffNamed(kind string, from []*yaml.Node, to []*yaml.Node) []Difference {
+	var diffs []Difference
+
+	for _, o := range from {
+		name, err := getName(o)
+		if err != nil {
+			continue
+		}
+		n, exists, _ := findValue(name, to)
+		if !exists {
+			diffs = append(diffs, Difference{Kind: kind, Name: name, Change: ChangeRemoved, Old: nodeValue(o)})
+			continue
+		}
+		diffs = append(diffs, diffNodes(kind, name, "", o, n)...)
+	}
+
+	for _, n := range to {
+		name, err := getName(n)
+		if err != nil {
+			continue
+		}
+		if _, exists, _ := findValue(name, from); !exists {
+			diffs = append(diffs, Difference{Kind: kind, Name: name, Change: ChangeAdded, New: nodeValue(n)})
+		}
+	}
+
+	return diffs
+}
+
+// diffNodes compares the values at path within an object. Maps are compared
+// key by key and lists item by item; anything else is compared whole.
+func diffNodes(kind string, name string, path string, from *yaml.Node, to *yaml.Node) []Difference {
+	if nodesEqual(from, to) {
+		return nil
+	}
+
+	changed := Difference{Kind: kind, Name: name, Change: ChangeChanged, Path: path, Old: nodeValue(from), New: nodeValue(to)}
+	if from.Kind != to.Kind {
+		return []Difference{changed}
+	}
+
+	var diffs []Difference
+	switch from.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(from.Content); i += 2 {
+			key := from.Content[i].Value
+			p := joinPath(path, key)
+			if n := mappingValue(to, key); n != nil {
+				diffs = append(diffs, diffNodes(kind, name, p, from.Content[i+1], n)...)
+			} else {
+				diffs = append(diffs, Difference{Kind: kind, Name: name, Change: ChangeRemoved, Path: p, Old: nodeValue(from.Content[i+1])})
+			}
+		}
+		for i := 0; i+1 < len(to.Content); i += 2 {
+			key := to.Content[i].Value
+			if mappingValue(from, key) == nil {
+				diffs = append(diffs, Difference{Kind: kind, Name: name, Change: ChangeAdded, Path: joinPath(path, key), New: nodeValue(to.Content[i+1])})
+			}
+		}
+	case yaml.SequenceNode:
+		for i := 0; i < len(from.Content) || i < len(to.Content); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(to.Content):
+				diffs = append(diffs, Difference{Kind: kind, Name: name, Change: ChangeRemoved, Path: p, Old: nodeValue(from.Content[i])})
+			case i >= len(from.Content):
+				diffs = append(diffs, Difference{Kind: kind, Name: name, Change: ChangeAdded, Path: p, New: nodeValue(to.Content[i])})
+			default:
+				diffs = append(diffs, diffNodes(kind, name, p, from.Content[i], to.Content[i])...)
+			}
+		}
+	default:
+		diffs = append(diffs, changed)
+	}
+	return diffs
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// nodeValue decodes n to a value which can be encoded as JSON.
+func nodeValue(n *yaml.Node) interface{} {
+	v, err := decodeNode(n)
+	if err != nil {
+		return nil
+	}
+	return jsonCompatible(v)
+}
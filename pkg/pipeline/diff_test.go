@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+func TestDiff(t *testing.T) {
+	y1 := `
+resources:
+- name: repo
+  type: git
+  source:
+    branch: master
+- name: old
+  type: git
+jobs:
+- name: deploy
+  serial: true
+  plan:
+  - get: repo
+  - task: build
+`
+	y2 := `
+jobs:
+- name: deploy
+  # Key order and comments are not differences.
+  plan:
+  - get: repo
+    trigger: true
+  serial: true
+resources:
+- name: repo
+  type: git
+  source:
+    branch: develop
+- name: new
+  type: time
+`
+	var p1 Pipeline
+	var p2 Pipeline
+	yaml.Unmarshal([]byte(y1), &p1)
+	yaml.Unmarshal([]byte(y2), &p2)
+
+	var result []string
+	for _, d := range Diff(&p1, &p2) {
+		result = append(result, d.String())
+	}
+
+	expected := []string{
+		`resource repo: source.branch changed: "master" -> "develop"`,
+		`resource old: removed`,
+		`resource new: added`,
+		`job deploy: plan[0].trigger added: true`,
+		`job deploy: plan[1] removed: {"task":"build"}`,
+	}
+	if strings.Join(result, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("[%v] is not equal to [%v]\n", strings.Join(result, "\n"), strings.Join(expected, "\n"))
+	}
+
+	if diffs := Diff(&p1, &p1); len(diffs) != 0 {
+		t.Errorf("Expected no differences between a pipeline and itself, got %v", diffs)
+	}
+}
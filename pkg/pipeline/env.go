@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envPolicy is the allow-list of environment variables templates may read,
+// set with WithEnv. A variable is allowed if it is named explicitly or starts
+// with one of the prefixes.
+type envPolicy struct {
+	prefixes []string
+	names    []string
+}
+
+func (e *envPolicy) allowed(name string) bool {
+	for _, n := range e.names {
+		if n == name {
+			return true
+		}
+	}
+	for _, prefix := range e.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envFieldPattern matches the variable names which can be fields of `.Env`.
+var envFieldPattern = regexp.MustCompile(`^[A-Z][A-Za-z0-9_]*$`)
+
+// vars returns the allowed variables as the fields of a struct, rather than a
+// map, so that a template reading any other `.Env` field fails instead of
+// silently rendering nothing. Variables named explicitly are present even
+// when unset. Names which cannot be exported Go fields are only available
+// via the `env` function.
+func (e *envPolicy) vars() interface{} {
+	values := map[string]string{}
+	for _, name := range e.names {
+		values[name] = os.Getenv(name)
+	}
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok && e.allowed(name) {
+			values[name] = value
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if envFieldPattern.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	fields := make([]reflect.StructField, len(names))
+	for i, name := range names {
+		fields[i] = reflect.StructField{Name: name, Type: reflect.TypeOf("")}
+	}
+	vars := reflect.New(reflect.StructOf(fields)).Elem()
+	for i, name := range names {
+		vars.Field(i).SetString(values[name])
+	}
+	return vars.Interface()
+}
+
+// env replaces Sprig's `env`, failing for variables not on the allow-list.
+func (e *envPolicy) env(name string) (string, error) {
+	if !e.allowed(name) {
+		return "", fmt.Errorf("%w: %s", ErrEnvNotAllowed, name)
+	}
+	return os.Getenv(name), nil
+}
+
+// expandenv replaces Sprig's `expandenv`, failing if s refers to any variable
+// not on the allow-list.
+func (e *envPolicy) expandenv(s string) (string, error) {
+	var denied []string
+	out := os.Expand(s, func(name string) string {
+		if !e.allowed(name) {
+			denied = append(denied, name)
+			return ""
+		}
+		return os.Getenv(name)
+	})
+	if len(denied) > 0 {
+		return "", fmt.Errorf("%w: %s", ErrEnvNotAllowed, strings.Join(denied, ", "))
+	}
+	return out, nil
+}
+
+// envFieldErrorPattern matches the error text/template gives for a template
+// reading a field of `.Env` which does not exist.
+var envFieldErrorPattern = regexp.MustCompile(`(?s)^(.* at <\$?\.Env\.(\w+)[^>]*>: )can't evaluate field (\w+) in type .*$`)
+
+// envFieldError is a template error restated as an ErrEnvNotAllowed error.
+type envFieldError struct {
+	msg string
+}
+
+func (e *envFieldError) Error() string {
+	return e.msg
+}
+
+func (e *envFieldError) Unwrap() error {
+	return ErrEnvNotAllowed
+}
+
+// explain restates the error from reading a field of `.Env` which is not on
+// the allow-list. Other errors are returned unchanged.
+func (e *envPolicy) explain(err error) error {
+	m := envFieldErrorPattern.FindStringSubmatch(err.Error())
+	if m == nil || m[2] != m[3] {
+		return err
+	}
+	return &envFieldError{msg: fmt.Sprintf("%s%v: %s", m[1], ErrEnvNotAllowed, m[2])}
+}
+
+// withEnv returns the data a template is rendered with: params with `Env`
+// set to the allowed environment variables. params which are not a map are
+// returned unchanged.
+func withEnv(params interface{}, e *envPolicy) interface{} {
+	if e == nil {
+		return params
+	}
+
+	switch p := params.(type) {
+	case nil:
+		return map[string]interface{}{"Env": e.vars()}
+	case map[string]interface{}:
+		data := make(map[string]interface{}, len(p)+1)
+		for k, v := range p {
+			data[k] = v
+		}
+		data["Env"] = e.vars()
+		return data
+	}
+	return params
+}
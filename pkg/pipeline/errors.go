@@ -0,0 +1,263 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrTemplateNotFound is returned (wrapped) when a `merge:` template cannot be
+// found on disk or in the template index.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// TemplateError is returned when a template cannot be read, parsed or
+// executed. Name is the template path as written in the pipeline, or
+// "pipeline" for the root pipeline.
+type TemplateError struct {
+	Name string
+	Err  error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("template %s: %v", e.Name, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// YAMLError is returned when the rendered output of a template is not a
+// well-formed pipeline document.
+type YAMLError struct {
+	Name string
+	Err  error
+}
+
+func (e *YAMLError) Error() string {
+	return fmt.Sprintf("yaml %s: %v", e.Name, e.Err)
+}
+
+func (e *YAMLError) Unwrap() error {
+	return e.Err
+}
+
+// MergeError is returned when a sub-pipeline cannot be merged into the
+// pipeline built so far, e.g. because two resources share a name but differ.
+type MergeError struct {
+	Name string
+	Err  error
+}
+
+func (e *MergeError) Error() string {
+	return fmt.Sprintf("merge %s: %v", e.Name, e.Err)
+}
+
+func (e *MergeError) Unwrap() error {
+	return e.Err
+}
+
+// MergeFrame is one step on the path of `merge:` entries from the root
+// pipeline down to a template.
+type MergeFrame struct {
+	Template string      `json:"template"`
+	Args     interface{} `json:"args,omitempty"`
+}
+
+// MarshalJSON encodes the frame, converting the YAML maps in Args to JSON
+// objects.
+func (f MergeFrame) MarshalJSON() ([]byte, error) {
+	type frame MergeFrame
+	return json.Marshal(frame{Template: f.Template, Args: jsonCompatible(f.Args)})
+}
+
+// PipelineError locates a failure within the merge tree. File, Line and
+// Column identify where the error originated as precisely as the underlying
+// error allows; for YAML errors Line refers to the rendered template output.
+// Chain lists the `merge:` entries, root pipeline first, that led to File.
+type PipelineError struct {
+	File   string
+	Line   int
+	Column int
+	Chain  []MergeFrame
+	Err    error
+}
+
+var (
+	templateErrorPattern = regexp.MustCompile(`(?s)^template: ([^:]+):(\d+)(?::(\d+))?: (.*)$`)
+	yamlErrorPattern     = regexp.MustCompile(`(?s)^(?:yaml: )?line (\d+): (.*)$`)
+)
+
+// newPipelineError wraps err with the location information available from
+// the merge chain ending at source. index is used to attribute errors raised
+// inside associated templates to their file.
+func newPipelineError(err error, source *mergeSource, index *templateIndex) error {
+	var pe *PipelineError
+	if err == nil || errors.As(err, &pe) {
+		return err
+	}
+
+	pe = &PipelineError{Chain: source.chain(), Err: err}
+	if source != nil {
+		pe.File = source.frame.Template
+	}
+
+	var te *TemplateError
+	var ye *YAMLError
+	switch {
+	case errors.As(err, &te):
+		if m := templateErrorPattern.FindStringSubmatch(te.Err.Error()); m != nil {
+			if m[1] != "pipeline" {
+				pe.File = m[1]
+				if resolved, err := index.lookup(m[1]); err == nil {
+					pe.File = resolved
+				}
+			}
+			pe.Line, _ = strconv.Atoi(m[2])
+			pe.Column, _ = strconv.Atoi(m[3])
+		}
+	case errors.As(err, &ye):
+		if m := yamlErrorPattern.FindStringSubmatch(ye.Err.Error()); m != nil {
+			pe.Line, _ = strconv.Atoi(m[1])
+		}
+	}
+
+	return pe
+}
+
+// Message returns the underlying error message without the location prefix
+// text/template and yaml add, since File, Line and Column carry it.
+func (e *PipelineError) Message() string {
+	var te *TemplateError
+	var ye *YAMLError
+	switch {
+	case errors.As(e.Err, &te):
+		if m := templateErrorPattern.FindStringSubmatch(te.Err.Error()); m != nil {
+			return m[4]
+		}
+		return te.Err.Error()
+	case errors.As(e.Err, &ye):
+		if m := yamlErrorPattern.FindStringSubmatch(ye.Err.Error()); m != nil {
+			return m[2]
+		}
+		return ye.Err.Error()
+	}
+	return e.Err.Error()
+}
+
+func (e *PipelineError) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, e.Line)
+		if e.Column > 0 {
+			location = fmt.Sprintf("%s:%d", location, e.Column)
+		}
+	}
+
+	templates := make([]string, len(e.Chain))
+	for i, f := range e.Chain {
+		templates[i] = f.Template
+	}
+
+	msg := fmt.Sprintf("%s: %s", location, e.Message())
+	if len(templates) > 1 {
+		msg = fmt.Sprintf("%s (merge chain: %s)", msg, strings.Join(templates, " -> "))
+	}
+	return msg
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON renders the error for machine consumption, e.g. with `--json`.
+func (e *PipelineError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		File    string       `json:"file"`
+		Line    int          `json:"line,omitempty"`
+		Column  int          `json:"column,omitempty"`
+		Message string       `json:"message"`
+		Chain   []MergeFrame `json:"chain"`
+	}{e.File, e.Line, e.Column, e.Message(), e.Chain})
+}
+
+// jsonCompatible converts the map[interface{}]interface{} values produced by
+// yaml.v2 into map[string]interface{} so they can be encoded as JSON.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, val := range v {
+			l[i] = jsonCompatible(val)
+		}
+		return l
+	}
+	return v
+}
+
+// ErrMaxMergeDepth is returned (wrapped) when `merge:` entries nest more
+// deeply than the limit set with WithMaxMergeDepth.
+var ErrMaxMergeDepth = errors.New("maximum merge depth exceeded")
+
+// ErrEnvNotAllowed is returned (wrapped) when a template reads an environment
+// variable which is not on the allow-list set with WithEnv.
+var ErrEnvNotAllowed = errors.New("environment variable not allowed")
+
+// MergeCycleError is returned when a template merges itself, either directly
+// or via other templates. Templates lists the cycle, starting and ending with
+// the repeated template.
+type MergeCycleError struct {
+	Templates []string
+}
+
+func (e *MergeCycleError) Error() string {
+	return fmt.Sprintf("merge cycle: %s", strings.Join(e.Templates, " -> "))
+}
+
+// AmbiguousTemplateError is returned when an unqualified template name is the
+// basename of more than one template. Candidates lists the qualified names
+// which could be used instead.
+type AmbiguousTemplateError struct {
+	Name       string
+	Candidates []string
+}
+
+func (e *AmbiguousTemplateError) Error() string {
+	return fmt.Sprintf("template name %q is ambiguous, use one of: %s", e.Name, strings.Join(e.Candidates, ", "))
+}
+
+// DuplicateError is returned when two templates define a job, resource,
+// resource type or var source with the same name differently, or both set
+// `display` differently, and the `merge:` entry has no strategy to resolve
+// them. Templates lists the existing definition's template first, or holds
+// the one template which defined the object more than once.
+type DuplicateError struct {
+	Kind      string
+	Name      string
+	Templates []string
+}
+
+func (e *DuplicateError) Error() string {
+	object := strings.Replace(e.Kind, "_", " ", -1)
+	if e.Name != "" {
+		object = fmt.Sprintf("%s %q", object, e.Name)
+	}
+	if len(e.Templates) == 1 {
+		return fmt.Sprintf("%s is defined more than once, differently, by %s", object, e.Templates[0])
+	}
+	return fmt.Sprintf("%s is defined differently by %s", object, strings.Join(e.Templates, " and "))
+}
@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// OSFS reads files from the operating system's file system. Unlike os.DirFS
+// it accepts any path the operating system does, absolute or relative to the
+// working directory, as UAV always has. It is the file system templates are
+// read from unless WithFS sets another.
+var OSFS fs.FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// WithFS reads the template files and `merge:` templates from fsys, e.g. an
+// embed.FS holding a bundled template library or an fstest.MapFS in tests.
+// Paths are then slash-separated and relative to the root of fsys, as io/fs
+// requires.
+func WithFS(fsys fs.FS) Option {
+	return func(o *options) {
+		o.fs = fsys
+	}
+}
+
+// fileSystem returns the file system set with WithFS, or OSFS.
+func (o *options) fileSystem() fs.FS {
+	if o == nil || o.fs == nil {
+		return OSFS
+	}
+	return o.fs
+}
+
+// readFile reads the named file from fsys. Paths UAV builds with
+// path/filepath are made valid io/fs paths for any file system but OSFS.
+func readFile(fsys fs.FS, name string) ([]byte, error) {
+	if _, ok := fsys.(osFS); !ok {
+		name = path.Clean(filepath.ToSlash(name))
+	}
+	return fs.ReadFile(fsys, name)
+}
+
+// isNotFound reports whether err means a file does not exist, or cannot
+// exist because its path is not valid for the file system.
+func isNotFound(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid)
+}
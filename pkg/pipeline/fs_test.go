@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"testing"
+	"testing/fstest"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+func TestTransformFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"pipelines/ci.yml": {Data: []byte(`
+merge:
+- template: jobs/build.yml
+  args:
+    name: build
+`)},
+		"pipelines/jobs/build.yml": {Data: []byte(`
+jobs:
+- name: {{ .name }}
+  plan:
+  - put: notify
+    params:
+      text: {{ include "notify.tpl" . }}
+`)},
+		"lib/notify.tpl": {Data: []byte(`{{ .name }} finished`)},
+	}
+	p := `
+merge:
+- template: ci.yml
+`
+	expectedPipeline := `
+jobs:
+- name: build
+  plan:
+  - put: notify
+    params:
+      text: build finished
+`
+	pipeline := new(Pipeline)
+	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
+	expected := pipeline.String()
+
+	merger, err := NewPipeline(p, nil, []string{"pipelines/ci.yml", "lib/notify.tpl"},
+		WithFS(fsys), WithPipelineFile("pipelines/root.yml"), WithResolution(ResolveRelative), WithTemplateRoots("lib"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err = merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	if result := pipeline.String(); result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+}
@@ -0,0 +1,162 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// Edge types in a Graph.
+const (
+	EdgeGet    = "get"
+	EdgePut    = "put"
+	EdgePassed = "passed"
+)
+
+// Graph is the dependency graph of a pipeline's jobs and resources.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a job or resource. ID is unique across kinds.
+type GraphNode struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// GraphEdge links two nodes by ID. A get edge runs from a resource to the job
+// fetching it, and Trigger is set if new versions trigger the job. A put edge
+// runs from a job to the resource it updates. A passed edge runs from an
+// upstream job to the job whose get of Resource is constrained by it.
+type GraphEdge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Type     string `json:"type"`
+	Resource string `json:"resource,omitempty"`
+	Trigger  bool   `json:"trigger,omitempty"`
+}
+
+// Graph derives the dependency graph of the pipeline from the `get` and `put`
+// steps of its jobs and their `passed` constraints. Nodes are listed jobs
+// first, then resources, in pipeline order; a resource or job which is
+// referred to but not declared is added after them.
+func (p *Pipeline) Graph() *Graph {
+	g := &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	nodes := map[string]bool{}
+	edges := map[GraphEdge]bool{}
+
+	node := func(kind string, name string) string {
+		id := kind + ":" + name
+		if !nodes[id] {
+			nodes[id] = true
+			g.Nodes = append(g.Nodes, GraphNode{ID: id, Kind: kind, Name: name})
+		}
+		return id
+	}
+	edge := func(e GraphEdge) {
+		if !edges[e] {
+			edges[e] = true
+			g.Edges = append(g.Edges, e)
+		}
+	}
+
+	for _, job := range p.Jobs {
+		if name, err := getName(job); err == nil {
+			node(kindJob, name)
+		}
+	}
+	for _, resource := range p.Resources {
+		if name, err := getName(resource); err == nil {
+			node(kindResource, name)
+		}
+	}
+
+	for _, job := range p.Jobs {
+		name, err := getName(job)
+		if err != nil {
+			continue
+		}
+		jobID := node(kindJob, name)
+
+		forEachStep(job, func(step *yaml.Node) {
+			action, _, resource, ok := stepResource(step)
+			if !ok {
+				return
+			}
+			resourceID := node(kindResource, resource)
+
+			if action == EdgePut {
+				edge(GraphEdge{From: jobID, To: resourceID, Type: EdgePut})
+				return
+			}
+			trigger, _ := scalarValue(mappingValue(step, "trigger"))
+			edge(GraphEdge{From: resourceID, To: jobID, Type: EdgeGet, Trigger: trigger == "true"})
+			for _, passed := range sequenceItems(mappingValue(step, "passed")) {
+				if upstream, ok := scalarValue(passed); ok {
+					edge(GraphEdge{From: node(kindJob, upstream), To: jobID, Type: EdgePassed, Resource: resource})
+				}
+			}
+		})
+	}
+
+	return g
+}
+
+// DOT renders the graph in Graphviz's DOT language. Jobs are boxes and
+// resources ellipses; gets which do not trigger their job are dashed.
+func (g *Graph) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph pipeline {\n")
+	b.WriteString("  rankdir=LR;\n")
+	for _, n := range g.Nodes {
+		shape := "ellipse"
+		if n.Kind == kindJob {
+			shape = "box"
+		}
+		fmt.Fprintf(&b, "  %q [label=%q, shape=%s];\n", n.ID, n.Name, shape)
+	}
+	for _, e := range g.Edges {
+		attrs := []string{fmt.Sprintf("label=%q", e.label())}
+		if e.Type == EdgeGet && !e.Trigger {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(&b, "  %q -> %q [%s];\n", e.From, e.To, strings.Join(attrs, ", "))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid renders the graph as a Mermaid flowchart. Jobs are rectangles and
+// resources stadiums; gets which do not trigger their job are dotted.
+func (g *Graph) Mermaid() string {
+	ids := make(map[string]string, len(g.Nodes))
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for i, n := range g.Nodes {
+		ids[n.ID] = fmt.Sprintf("n%d", i)
+		label := strings.Replace(n.Name, `"`, "#quot;", -1)
+		if n.Kind == kindJob {
+			fmt.Fprintf(&b, "  %s[\"%s\"]\n", ids[n.ID], label)
+		} else {
+			fmt.Fprintf(&b, "  %s([\"%s\"])\n", ids[n.ID], label)
+		}
+	}
+	for _, e := range g.Edges {
+		arrow := "-->"
+		if e.Type == EdgeGet && !e.Trigger {
+			arrow = "-.->"
+		}
+		fmt.Fprintf(&b, "  %s %s|%s| %s\n", ids[e.From], arrow, strings.Replace(e.label(), `"`, "#quot;", -1), ids[e.To])
+	}
+	return b.String()
+}
+
+func (e GraphEdge) label() string {
+	if e.Type == EdgePassed {
+		return fmt.Sprintf("passed: %s", e.Resource)
+	}
+	return e.Type
+}
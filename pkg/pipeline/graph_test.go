@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"testing"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+func TestGraph(t *testing.T) {
+	y := `
+resources:
+- name: repo
+  type: git
+- name: image
+  type: registry-image
+jobs:
+- name: build
+  plan:
+  - get: repo
+    trigger: true
+  - put: image
+- name: deploy
+  plan:
+  - in_parallel:
+    - get: image
+      passed: [build]
+      trigger: true
+    - get: repo
+      passed: [build]
+`
+	var p Pipeline
+	yaml.Unmarshal([]byte(y), &p)
+
+	expectedDOT := `digraph pipeline {
+  rankdir=LR;
+  "job:build" [label="build", shape=box];
+  "job:deploy" [label="deploy", shape=box];
+  "resource:repo" [label="repo", shape=ellipse];
+  "resource:image" [label="image", shape=ellipse];
+  "resource:repo" -> "job:build" [label="get"];
+  "job:build" -> "resource:image" [label="put"];
+  "resource:image" -> "job:deploy" [label="get"];
+  "job:build" -> "job:deploy" [label="passed: image"];
+  "resource:repo" -> "job:deploy" [label="get", style=dashed];
+  "job:build" -> "job:deploy" [label="passed: repo"];
+}
+`
+	if result := p.Graph().DOT(); result != expectedDOT {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expectedDOT)
+	}
+
+	expectedMermaid := `flowchart LR
+  n0["build"]
+  n1["deploy"]
+  n2(["repo"])
+  n3(["image"])
+  n2 -->|get| n0
+  n0 -->|put| n3
+  n3 -->|get| n1
+  n0 -->|passed: image| n1
+  n2 -.->|get| n1
+  n0 -->|passed: repo| n1
+`
+	if result := p.Graph().Mermaid(); result != expectedMermaid {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expectedMermaid)
+	}
+}
@@ -0,0 +1,279 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// Job keys naming the groups a job belongs to. Concourse does not know them,
+// so they are removed from the output.
+const (
+	groupAnnotation  = "group"
+	groupsAnnotation = "groups"
+)
+
+// GroupRule adds every job whose name matches Match to the group Name.
+type GroupRule struct {
+	Name  string
+	Match *regexp.Regexp
+}
+
+// ParseGroupRule parses a rule written as NAME=REGEX.
+func ParseGroupRule(rule string) (GroupRule, error) {
+	name, pattern, ok := strings.Cut(rule, "=")
+	if !ok || name == "" {
+		return GroupRule{}, fmt.Errorf("expected name=regex")
+	}
+	return newGroupRule(name, pattern)
+}
+
+func newGroupRule(name string, pattern string) (GroupRule, error) {
+	match, err := regexp.Compile(pattern)
+	if err != nil {
+		return GroupRule{}, fmt.Errorf("group %s: %v", name, err)
+	}
+	return GroupRule{Name: name, Match: match}, nil
+}
+
+// groupSettings are the `uav: {groups: ...}` settings, which generate groups
+// in addition to those set with WithGroupRules and WithAllGroup.
+type groupSettings struct {
+	All   string `yaml:"all,omitempty"`
+	Rules []struct {
+		Name  string `yaml:"name"`
+		Match string `yaml:"match"`
+	} `yaml:"rules,omitempty"`
+}
+
+// rules parses the settings' rules.
+func (s groupSettings) rules() ([]GroupRule, error) {
+	var rules []GroupRule
+	for _, r := range s.Rules {
+		rule, err := newGroupRule(r.Name, r.Match)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// WithGroupRules adds the jobs matching each rule to its group, after any
+// rules in the pipeline's `uav: {groups: {rules: ...}}` setting.
+func WithGroupRules(rules ...GroupRule) Option {
+	return func(o *options) {
+		o.groupRules = append(o.groupRules, rules...)
+	}
+}
+
+// WithAllGroup adds a group of the given name listing every job, overriding
+// any `uav: {groups: {all: ...}}` setting. The group is placed first unless
+// the pipeline already has one of that name.
+func WithAllGroup(name string) Option {
+	return func(o *options) {
+		o.allGroup = name
+	}
+}
+
+// generateGroups completes the groups of a transformed pipeline: jobs are
+// added to the groups named by their `group` or `groups` keys, which are then
+// removed, and to those of any matching rule and the all group. Repeated
+// entries within a group are removed, and entries which name no job are
+// reported as warnings.
+func (p *Pipeline) generateGroups() error {
+	var rules []GroupRule
+	var all string
+	if p.opts != nil {
+		rules, all = p.opts.groupRules, p.opts.allGroup
+	}
+
+	// members lists the jobs to add to each group, and added the groups in
+	// the order jobs were first added to them.
+	members := map[string][]string{}
+	var added []string
+	add := func(group string, job string) {
+		if _, ok := members[group]; !ok {
+			added = append(added, group)
+		}
+		members[group] = append(members[group], job)
+	}
+
+	// Groups the pipeline does not already have are attributed to the
+	// template of the first job annotated with them, or recorded as
+	// generated by a rule or as the all group.
+	origins := make(map[objectKey]*mergeSource, len(p.origins))
+	for k, v := range p.origins {
+		origins[k] = v
+	}
+	generated := map[string]string{}
+	record := func(group string, source *mergeSource, reason string) {
+		key := objectKey{kindGroup, group}
+		if _, ok := origins[key]; ok || generated[group] != "" || p.has(kindGroup, group) {
+			return
+		}
+		if reason != "" {
+			generated[group] = reason
+			return
+		}
+		origins[key] = source
+	}
+
+	jobs := make([]*yaml.Node, len(p.Jobs))
+	var names []string
+	for i, job := range p.Jobs {
+		jobs[i] = job
+		name, err := getName(job)
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+
+		annotated, stripped, err := jobGroups(name, job)
+		if err != nil {
+			return newPipelineError(err, p.origin(kindJob, name), p.templateIndex)
+		}
+		jobs[i] = stripped
+		for _, group := range annotated {
+			add(group, name)
+			record(group, p.origin(kindJob, name), "")
+		}
+	}
+	for _, rule := range rules {
+		for _, name := range names {
+			if rule.Match.MatchString(name) {
+				add(rule.Name, name)
+				record(rule.Name, nil, fmt.Sprintf("group rule %s=%s", rule.Name, rule.Match))
+			}
+		}
+	}
+	if all != "" {
+		record(all, nil, "all group")
+	}
+
+	groups := append([]*yaml.Node{}, p.Groups...)
+	for _, group := range added {
+		groups = addToGroup(groups, group, members[group], false)
+	}
+	if all != "" {
+		groups = addToGroup(groups, all, names, true)
+	}
+
+	for i, group := range groups {
+		groups[i] = dedupGroup(group)
+	}
+
+	p.Jobs = jobs
+	if len(groups) > 0 {
+		p.Groups = groups
+	}
+	p.origins = origins
+	if len(generated) > 0 {
+		p.generated = generated
+	}
+	p.checkGroups()
+	return nil
+}
+
+// jobGroups returns the groups a job's annotations name, and the job without
+// them.
+func jobGroups(name string, job *yaml.Node) ([]string, *yaml.Node, error) {
+	var groups []string
+	stripped := *job
+	stripped.Content = nil
+	for i := 0; i+1 < len(job.Content); i += 2 {
+		key, value := job.Content[i].Value, job.Content[i+1]
+		if key != groupAnnotation && key != groupsAnnotation {
+			stripped.Content = append(stripped.Content, job.Content[i], value)
+			continue
+		}
+		if isNull(value) {
+			continue
+		}
+
+		items := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			items = value.Content
+		}
+		for _, item := range items {
+			group, ok := scalarValue(item)
+			if !ok {
+				return nil, nil, &YAMLError{Name: "jobs", Err: fmt.Errorf("line %d: %s of job %s should be a group name or list of group names", value.Line, key, name)}
+			}
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 && len(stripped.Content) == len(job.Content) {
+		return nil, job, nil
+	}
+	return groups, &stripped, nil
+}
+
+// addToGroup returns groups with jobs added to the named group. A new group
+// is appended, or placed first if first is set.
+func addToGroup(groups []*yaml.Node, name string, jobs []string, first bool) []*yaml.Node {
+	entries := make([]*yaml.Node, len(jobs))
+	for i, job := range jobs {
+		entries[i] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: job}
+	}
+
+	index, _ := findIndex(name, groups)
+	if index < 0 {
+		group := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setMappingValue(group, "name", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name})
+		setMappingValue(group, "jobs", &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: entries})
+		if first {
+			return append([]*yaml.Node{group}, groups...)
+		}
+		return append(groups, group)
+	}
+
+	group := copyNode(groups[index])
+	existing := mappingValue(group, "jobs")
+	if existing == nil || existing.Kind != yaml.SequenceNode {
+		existing = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		setMappingValue(group, "jobs", existing)
+	}
+	existing.Content = append(existing.Content, entries...)
+	groups[index] = group
+	return groups
+}
+
+// dedupGroup returns group without repeated job entries.
+func dedupGroup(group *yaml.Node) *yaml.Node {
+	jobs := mappingValue(group, "jobs")
+	seen := map[string]bool{}
+	var entries []*yaml.Node
+	for _, entry := range sequenceItems(jobs) {
+		if name, ok := scalarValue(entry); ok {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == len(sequenceItems(jobs)) {
+		return group
+	}
+
+	out := copyNode(group)
+	deduped := *jobs
+	deduped.Content = entries
+	setMappingValue(out, "jobs", &deduped)
+	return out
+}
+
+// checkGroups warns about group entries which name no job.
+func (p *Pipeline) checkGroups() {
+	v := validator{pipeline: p}
+	v.jobs = v.names(p.Jobs)
+	for _, group := range p.Groups {
+		v.validateGroup(group)
+	}
+	for _, e := range v.errors {
+		p.warnings = append(p.warnings, e.Error())
+	}
+}
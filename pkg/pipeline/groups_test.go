@@ -0,0 +1,162 @@
+package pipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+func TestGenerateGroups(t *testing.T) {
+	p := `
+groups:
+- name: build
+  jobs:
+  - compile
+  - compile
+  - missing
+jobs:
+- name: compile
+  group: build
+  plan: []
+- name: deploy-qa
+  groups: [deploy, qa]
+  plan: []
+- name: deploy-prod
+  plan: []
+`
+	expectedPipeline := `
+groups:
+- name: all
+  jobs:
+  - compile
+  - deploy-qa
+  - deploy-prod
+- name: build
+  jobs:
+  - compile
+  - missing
+- name: deploy
+  jobs:
+  - deploy-qa
+  - deploy-prod
+- name: qa
+  jobs:
+  - deploy-qa
+jobs:
+- name: compile
+  plan: []
+- name: deploy-qa
+  plan: []
+- name: deploy-prod
+  plan: []
+`
+	pipeline := new(Pipeline)
+	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
+	expected := pipeline.String()
+
+	rule, err := ParseGroupRule("deploy=^deploy-")
+	if err != nil {
+		t.Fatalf("Error parsing group rule: %v", err)
+	}
+	merger, err := NewPipeline(p, nil, nil, WithGroupRules(rule), WithAllGroup("all"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err = merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	if result := pipeline.String(); result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+	warnings := pipeline.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `group build: unknown job "missing"`) {
+		t.Errorf("Expected a warning about the unknown job, got %v", warnings)
+	}
+}
+
+func TestGenerateGroupsFromSettings(t *testing.T) {
+	p := `
+uav:
+  groups:
+    all: All
+    rules:
+    - name: qa
+      match: -qa$
+jobs:
+- name: deploy-qa
+  plan: []
+- name: deploy-prod
+  plan: []
+`
+	expectedPipeline := `
+groups:
+- name: All
+  jobs:
+  - deploy-qa
+  - deploy-prod
+- name: qa
+  jobs:
+  - deploy-qa
+jobs:
+- name: deploy-qa
+  plan: []
+- name: deploy-prod
+  plan: []
+`
+	pipeline := new(Pipeline)
+	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
+	expected := pipeline.String()
+
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err = merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	if result := pipeline.String(); result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+}
+
+func TestGenerateGroupsErrors(t *testing.T) {
+	if _, err := ParseGroupRule("deploy"); err == nil {
+		t.Errorf("Expected a rule without a regex to fail")
+	}
+	if _, err := ParseGroupRule("deploy=("); err == nil {
+		t.Errorf("Expected a rule with an invalid regex to fail")
+	}
+
+	p := `
+jobs:
+- name: deploy
+  group: {name: deploy}
+  plan: []
+`
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	_, err = merger.Transform()
+	var ye *YAMLError
+	if !errors.As(err, &ye) || !strings.Contains(err.Error(), "group of job deploy should be a group name") {
+		t.Errorf("Expected an error for the invalid group annotation, got %v", err)
+	}
+
+	p = `
+uav:
+  groups:
+    rules:
+    - name: deploy
+      match: (
+`
+	if _, err := NewPipeline(p, nil, nil); err == nil {
+		t.Errorf("Expected an invalid group rule setting to fail")
+	}
+}
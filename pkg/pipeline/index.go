@@ -0,0 +1,207 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// templateIndex records the names each template file can be referred to by
+// from `merge:`, `{{ template }}`, `{{ include }}` and `exists`.
+//
+// A file found under one of the template roots (the `-d` directories) is
+// named by its slash-separated path relative to that root, e.g.
+// `slack/on_failure.tpl`. A file at the top of a root is also named with the
+// root's own basename in front, e.g. `slack/on_failure.tpl` for
+// `-d templates/slack`, so that it can be told apart from a file of the same
+// name at the top of another root. Every file may also be referred to by its
+// basename, as text/template's ParseFiles names them, as long as that
+// basename is unique across all templates. A name given to more than one
+// file is ambiguous, and so unusable, rather than taken by either of them.
+type templateIndex struct {
+	names   map[string][]string // name -> paths
+	aliases map[string][]string // path -> names
+	bases   map[string][]string // basename -> paths
+	order   []string            // names, in the order given
+	fsys    fs.FS               // where the files are read from
+	cache   templateCache       // files read and templates parsed so far
+}
+
+// buildTemplateIndex names each template file relative to the first of roots
+// containing it, or by its basename when it is outside all of them.
+func buildTemplateIndex(templates []string, roots []string, fsys fs.FS) *templateIndex {
+	index := &templateIndex{
+		names:   make(map[string][]string, len(templates)),
+		aliases: make(map[string][]string, len(templates)),
+		bases:   make(map[string][]string, len(templates)),
+		fsys:    fsys,
+	}
+
+	for _, f := range templates {
+		f = filepath.Clean(f)
+		for _, name := range qualifiedNames(f, roots) {
+			if contains(index.names[name], f) {
+				continue
+			}
+			if _, ok := index.names[name]; !ok {
+				index.order = append(index.order, name)
+			}
+			index.names[name] = append(index.names[name], f)
+			index.aliases[f] = append(index.aliases[f], name)
+		}
+
+		base := filepath.Base(f)
+		if !contains(index.bases[base], f) {
+			index.bases[base] = append(index.bases[base], f)
+		}
+	}
+	return index
+}
+
+// qualifiedNames returns the names of file relative to the first of roots
+// containing it, or its basename when it is outside all of them.
+func qualifiedNames(file string, roots []string) []string {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		prefix := filepath.Base(filepath.Clean(root))
+		if strings.Contains(rel, "/") || prefix == "." || prefix == ".." || prefix == string(filepath.Separator) {
+			return []string{rel}
+		}
+		return []string{rel, prefix + "/" + rel}
+	}
+	return []string{filepath.Base(file)}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the file a template name refers to. A qualified name is
+// matched exactly; otherwise the basename of name must identify a single
+// template. It returns ErrTemplateNotFound (wrapped) when nothing matches.
+func (i *templateIndex) lookup(name string) (string, error) {
+	if i == nil {
+		return "", ErrTemplateNotFound
+	}
+
+	paths, ok := i.names[filepath.ToSlash(name)]
+	if !ok {
+		name = filepath.Base(name)
+		paths = i.bases[name]
+	}
+	switch len(paths) {
+	case 0:
+		return "", ErrTemplateNotFound
+	case 1:
+		return paths[0], nil
+	}
+	return "", &AmbiguousTemplateError{Name: name, Candidates: i.candidates(name, paths)}
+}
+
+// ambiguous reports the names an unqualified or clashing name could refer
+// to, if there is more than one.
+func (i *templateIndex) ambiguous(name string) []string {
+	if i == nil {
+		return nil
+	}
+	paths, ok := i.names[name]
+	if !ok {
+		paths = i.bases[name]
+	}
+	if len(paths) > 1 {
+		return i.candidates(name, paths)
+	}
+	return nil
+}
+
+// candidates returns, for each of paths, a name other than name which refers
+// to it alone, or the path itself if it has none.
+func (i *templateIndex) candidates(name string, paths []string) []string {
+	out := make([]string, 0, len(paths))
+	for _, path := range paths {
+		candidate := path
+		for _, alias := range i.aliases[path] {
+			if alias != name && len(i.names[alias]) == 1 {
+				candidate = alias
+				break
+			}
+		}
+		out = append(out, candidate)
+	}
+	return out
+}
+
+// parseInto parses every indexed template into t under each of its names,
+// and under its basename where that is unambiguous. An ambiguous name is
+// bound to a template which fails when executed, so that `{{ template }}`
+// and `{{ include }}` report the ambiguity rather than silently picking one.
+func (i *templateIndex) parseInto(t *template.Template) error {
+	if i == nil {
+		return nil
+	}
+
+	parsed := make(map[string]string, len(i.aliases))
+	bind := func(name string, paths []string) error {
+		if len(paths) > 1 {
+			_, err := t.New(name).Parse(fmt.Sprintf("{{ ambiguousTemplate %q }}", name))
+			return err
+		}
+		if first, ok := parsed[paths[0]]; ok {
+			if tmpl := t.Lookup(first); tmpl != nil && tmpl.Tree != nil {
+				_, err := t.AddParseTree(name, tmpl.Tree)
+				return err
+			}
+			return nil
+		}
+		data, err := i.read(i.fsys, paths[0])
+		if err != nil {
+			return err
+		}
+		if _, err := t.New(name).Parse(string(data)); err != nil {
+			return err
+		}
+		parsed[paths[0]] = name
+		return nil
+	}
+
+	for _, name := range i.order {
+		if err := bind(name, i.names[name]); err != nil {
+			return err
+		}
+	}
+
+	bases := make([]string, 0, len(i.bases))
+	for base := range i.bases {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	for _, base := range bases {
+		if _, ok := i.names[base]; ok {
+			continue
+		}
+		if err := bind(base, i.bases[base]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ambiguousTemplate is bound to ambiguous basenames by parseInto.
+func ambiguousTemplate(index *templateIndex) func(string) (string, error) {
+	return func(name string) (string, error) {
+		return "", &AmbiguousTemplateError{Name: name, Candidates: index.ambiguous(name)}
+	}
+}
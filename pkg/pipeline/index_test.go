@@ -0,0 +1,167 @@
+package pipeline
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+var namespacedTemplates = []string{
+	"test.d/namespaced/email/job.yaml",
+	"test.d/namespaced/email/on_failure.tpl",
+	"test.d/namespaced/slack/on_failure.tpl",
+}
+
+func TestIndexQualifiedNames(t *testing.T) {
+	p := `
+jobs:
+- name: test
+  plan:
+{{ include "slack/on_failure.tpl" | indent 2 }}
+  a: {{ if exists "email/on_failure.tpl" }}yes_value{{ else }}no_value{{ end }}
+  b: {{ if exists "job.yaml" }}yes_value{{ else }}no_value{{ end }}
+merge:
+- template: email/job.yaml
+`
+	expectedPipeline := `
+jobs:
+- name: test
+  plan:
+  - put: slack-alert
+  a: yes_value
+  b: yes_value
+- name: notify
+  plan:
+  - put: email-alert
+`
+	pipeline := new(Pipeline)
+	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
+	expected := pipeline.String()
+
+	merger, err := NewPipeline(p, nil, namespacedTemplates, WithTemplateRoots("test.d/namespaced"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	pipeline, err = merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	result := pipeline.String()
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+}
+
+func TestIndexAmbiguousBasename(t *testing.T) {
+	tests := []string{
+		`{{ include "on_failure.tpl" }}`,
+		`{{ template "on_failure.tpl" }}`,
+		`{{ exists "on_failure.tpl" }}`,
+		"merge:\n- template: somewhere/on_failure.tpl\n",
+	}
+
+	for _, p := range tests {
+		merger, err := NewPipeline(p, nil, namespacedTemplates, WithTemplateRoots("test.d/namespaced"))
+		if err == nil {
+			_, err = merger.Transform()
+		}
+
+		var ae *AmbiguousTemplateError
+		if !errors.As(err, &ae) {
+			t.Errorf("Expected an AmbiguousTemplateError for %q, got %v", p, err)
+			continue
+		}
+		if len(ae.Candidates) != 2 || ae.Candidates[0] != "email/on_failure.tpl" || ae.Candidates[1] != "slack/on_failure.tpl" {
+			t.Errorf("Unexpected candidates for %q: %v", p, ae.Candidates)
+		}
+	}
+}
+
+func TestIndexClashingRoots(t *testing.T) {
+	fsys := fstest.MapFS{
+		"d/slack/on_failure.tpl": {Data: []byte("- put: slack-alert\n")},
+		"d/email/on_failure.tpl": {Data: []byte("- put: email-alert\n")},
+	}
+	templates := []string{"d/slack/on_failure.tpl", "d/email/on_failure.tpl"}
+
+	tests := []string{
+		`{{ include "on_failure.tpl" }}`,
+		`{{ template "on_failure.tpl" }}`,
+		`{{ exists "on_failure.tpl" }}`,
+		"merge:\n- template: on_failure.tpl\n",
+	}
+	for _, p := range tests {
+		merger, err := NewPipeline(p, nil, templates, WithFS(fsys), WithTemplateRoots("d/slack", "d/email"))
+		if err == nil {
+			_, err = merger.Transform()
+		}
+
+		var ae *AmbiguousTemplateError
+		if !errors.As(err, &ae) {
+			t.Errorf("Expected an AmbiguousTemplateError for %q, got %v", p, err)
+			continue
+		}
+		if len(ae.Candidates) != 2 || ae.Candidates[0] != "slack/on_failure.tpl" || ae.Candidates[1] != "email/on_failure.tpl" {
+			t.Errorf("Unexpected candidates for %q: %v", p, ae.Candidates)
+		}
+	}
+
+	p := `
+jobs:
+- name: test
+  plan:
+{{ include "email/on_failure.tpl" | indent 2 }}
+`
+	merger, err := NewPipeline(p, nil, templates, WithFS(fsys), WithTemplateRoots("d/slack", "d/email"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+	result, err := pipeline.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling pipeline: %v", err)
+	}
+	expected := `jobs:
+- name: test
+  plan:
+  - put: email-alert
+`
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+}
+
+func TestIndexClashingTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"x1/on.tpl": {Data: []byte("one")},
+		"x2/on.tpl": {Data: []byte("two")},
+	}
+	templates := []string{"x1/on.tpl", "x2/on.tpl"}
+
+	tests := []string{
+		`{{ template "on.tpl" }}`,
+		"merge:\n- template: on.tpl\n",
+	}
+	for _, p := range tests {
+		merger, err := NewPipeline(p, nil, templates, WithFS(fsys))
+		if err == nil {
+			_, err = merger.Transform()
+		}
+
+		var ae *AmbiguousTemplateError
+		if !errors.As(err, &ae) {
+			t.Errorf("Expected an AmbiguousTemplateError for %q, got %v", p, err)
+			continue
+		}
+		if len(ae.Candidates) != 2 || ae.Candidates[0] != "x1/on.tpl" || ae.Candidates[1] != "x2/on.tpl" {
+			t.Errorf("Unexpected candidates for %q: %v", p, ae.Candidates)
+		}
+	}
+}
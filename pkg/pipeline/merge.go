@@ -2,75 +2,149 @@ package pipeline
 
 import (
 	"fmt"
-	"reflect"
 
-	"github.com/finbourne/uav/pkg/log"
+	yaml "go.yaml.in/yaml/v3"
 )
 
-func merge(p1 Pipeline, p2 Pipeline) (Pipeline, error) {
+// mergeWithStrategy merges the sub-pipeline p2 into p1, resolving resources,
+// resource types and jobs which share a name with s. Without a strategy,
+// repeated objects must be identical and are collapsed into one. Unless a
+// sort order is set, p2's resources, resource types and var sources are
+// placed before p1's.
+func mergeWithStrategy(p1 Pipeline, p2 Pipeline, s Strategy) (Pipeline, error) {
 	out := Pipeline{}
-	var resourceTypesOK, resourcesOK bool
-	out.Groups = mergeGroups(p1.Groups, p2.Groups)
-	out.Jobs = appendArrayInterfaceNoCheck(p1.Jobs, p2.Jobs)
-	out.Merge = appendArrayInterfaceNoCheck(p1.Merge, p2.Merge)
-	out.ResourceTypes, resourceTypesOK = mergeArrayInterfaceCheckSame(p1.ResourceTypes, p2.ResourceTypes)
-	out.Resources, resourcesOK = mergeArrayInterfaceCheckSame(p1.Resources, p2.Resources)
-	// p2 is always a sub-pipeline parsed from a merged YAML file (built via
-	// mapInterfaceInterfaceToPipeline), so it never carries the CLI-supplied
-	// template loading context. Only p1 does — propagate it as-is.
-	out.extraTemplates = p1.extraTemplates
+	incomingFirst := p1.opts.sortOrder() == ""
+	var err error
+	var varSourcesConflict, resourceTypesConflict, resourcesConflict, jobsConflict string
+	out.Groups, err = mergeGroups(p1.Groups, p2.Groups)
+	if err != nil {
+		return Pipeline{}, fmt.Errorf("groups merge error; %v", err)
+	}
+	out.Jobs, jobsConflict, err = mergeNamed(p1.Jobs, p2.Jobs, s, false)
+	if err != nil {
+		return Pipeline{}, fmt.Errorf("jobs merge error; %v", err)
+	}
+	out.Merge = appendNodes(p1.Merge, p2.Merge)
+	out.mergeSources = append(p1.sources(), p2.sources()...)
+	out.ResourceTypes, resourceTypesConflict, err = mergeNamed(p1.ResourceTypes, p2.ResourceTypes, s, incomingFirst)
+	if err != nil {
+		return Pipeline{}, fmt.Errorf("resourceTypes merge error; %v", err)
+	}
+	out.Resources, resourcesConflict, err = mergeNamed(p1.Resources, p2.Resources, s, incomingFirst)
+	if err != nil {
+		return Pipeline{}, fmt.Errorf("resource merge error; %v", err)
+	}
+	out.VarSources, varSourcesConflict, err = mergeNamed(p1.VarSources, p2.VarSources, s, incomingFirst)
+	if err != nil {
+		return Pipeline{}, fmt.Errorf("varSources merge error; %v", err)
+	}
+	var displayOK bool
+	out.Display, displayOK = resolveNodes(p1.Display, p2.Display, s)
+	// p2 is always a sub-pipeline parsed from a merged YAML file, so it
+	// never carries the CLI-supplied template loading context. Only p1
+	// does — propagate it as-is.
 	out.templateIndex = p1.templateIndex
-
-	if !resourceTypesOK && !resourcesOK {
-		return Pipeline{}, fmt.Errorf("resourceTypes and resource merge error;  two or more items that are not identical")
+	out.root = p1.root
+	out.opts = p1.opts
+	out.origins = mergeOrigins(p1, p2, s)
+	out.stepOrigins = mergeStepOrigins(p1, p2)
+	out.warnings = append(append([]string{}, p1.warnings...), p2.warnings...)
+	out.keys = mergeKeys(p1.keys, p2.keys)
+	out.headComment, out.footComment = p1.headComment, p1.footComment
+
+	conflicts := []struct {
+		kind string
+		name string
+	}{
+		{kindVarSource, varSourcesConflict},
+		{kindResourceType, resourceTypesConflict},
+		{kindResource, resourcesConflict},
+		{kindJob, jobsConflict},
 	}
-
-	if !resourceTypesOK {
-		return Pipeline{}, fmt.Errorf("resourceTypes merge error; two or more resourceTypes are not identical")
+	for _, c := range conflicts {
+		if c.name != "" {
+			return Pipeline{}, duplicateError(p1, p2, c.kind, c.name)
+		}
 	}
-	if !resourcesOK {
-		return Pipeline{}, fmt.Errorf("resource merge error; two or more resources are not identical")
+	if !displayOK {
+		return Pipeline{}, duplicateError(p1, p2, kindDisplay, "")
 	}
 
 	return out, nil
 }
 
-func mergeGroups(a []interface{}, b []interface{}) []interface{} {
-	out := make([]interface{}, 0)
+// duplicateError reports the templates which defined the named object
+// differently.
+func duplicateError(p1 Pipeline, p2 Pipeline, kind string, name string) *DuplicateError {
+	existing := p2.source
+	if p1.has(kind, name) {
+		existing = p1.origin(kind, name)
+	}
+	return &DuplicateError{
+		Kind:      kind,
+		Name:      name,
+		Templates: []string{existing.template(), p2.source.template()},
+	}
+}
+
+func mergeGroups(a []*yaml.Node, b []*yaml.Node) ([]*yaml.Node, error) {
+	out := make([]*yaml.Node, 0)
 
 	out = append(out, a...)
 
 	for _, v := range b {
-		name := getName(v)
-		value, exists := findValue(name, out)
-		if exists {
-			index := findIndex(name, out)
-			ngroup := interfaceToMapStringInterface(v)
-			njobs := ngroup["jobs"].([]interface{})
-			egroup := interfaceToMapStringInterface(value)
-			for _, j := range njobs {
-				egroup["jobs"] = append(egroup["jobs"].([]interface{}), j)
-			}
-			out[index] = mapStringInterfaceToMapInterfaceInterface(egroup)
+		name, err := getName(v)
+		if err != nil {
+			return nil, err
+		}
+		index, err := findIndex(name, out)
+		if err != nil {
+			return nil, err
 		}
-		if !exists {
+		if index < 0 {
 			out = append(out, v)
+			continue
+		}
+
+		njobs, err := groupJobs(name, v)
+		if err != nil {
+			return nil, err
 		}
+		if njobs == nil {
+			continue
+		}
+		egroup := copyNode(out[index])
+		ejobs, err := groupJobs(name, egroup)
+		if err != nil {
+			return nil, err
+		}
+		if ejobs == nil {
+			ejobs = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			setMappingValue(egroup, "jobs", ejobs)
+		}
+		for _, j := range njobs.Content {
+			ejobs.Content = append(ejobs.Content, copyNode(j))
+		}
+		out[index] = egroup
 	}
 
-	return out
+	return out, nil
 }
 
-func mapStringInterfaceToMapInterfaceInterface(data map[string]interface{}) map[interface{}]interface{} {
-	out := make(map[interface{}]interface{})
-	for k, v := range data {
-		out[k] = v
+// groupJobs returns the `jobs` list of a group, or nil if it has none.
+func groupJobs(name string, group *yaml.Node) (*yaml.Node, error) {
+	jobs := mappingValue(group, "jobs")
+	if isNull(jobs) {
+		return nil, nil
 	}
-	return out
+	if jobs.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("line %d: jobs of group %s should be a list", jobs.Line, name)
+	}
+	return jobs, nil
 }
 
-func appendArrayInterfaceNoCheck(a []interface{}, b []interface{}) []interface{} {
-	out := make([]interface{}, 0)
+func appendNodes(a []*yaml.Node, b []*yaml.Node) []*yaml.Node {
+	out := make([]*yaml.Node, 0)
 
 	out = append(out, a...)
 	out = append(out, b...)
@@ -78,66 +152,36 @@ func appendArrayInterfaceNoCheck(a []interface{}, b []interface{}) []interface{}
 	return out
 }
 
-func mergeArrayInterfaceCheckSame(a []interface{}, b []interface{}) ([]interface{}, bool) {
-	out := make([]interface{}, 0)
-
-	out = append(out, b...)
-
-	for _, v := range a {
-		name := getName(v)
-		value, exists := findValue(name, out)
-		valuesEqual := valuesSame(value, v)
-		if exists && !valuesEqual {
-			return out, false
-		}
-		if !exists {
-			out = append(out, v)
-		}
+func getName(data *yaml.Node) (string, error) {
+	if data == nil || data.Kind != yaml.MappingNode {
+		return "", fmt.Errorf("item should be a map")
 	}
-
-	return out, true
-}
-
-func getName(data interface{}) string {
-	return interfaceToMapStringInterface(data)["name"].(string)
-}
-
-func interfaceToMapStringInterface(data interface{}) map[string]interface{} {
-	m := make(map[string]interface{})
-	interim := data.(map[interface{}]interface{})
-	for key, value := range interim {
-		switch key := key.(type) {
-		case string:
-			m[key] = value
-		default:
-			log.Fatal("key should be string")
-		}
+	name, ok := scalarValue(mappingValue(data, "name"))
+	if !ok {
+		return "", fmt.Errorf("line %d: item should have a string name", data.Line)
 	}
-	return m
+	return name, nil
 }
 
-func findValue(name string, a []interface{}) (interface{}, bool) {
-	for _, data := range a {
-		c := interfaceToMapStringInterface(data)
-		if c["name"].(string) == name {
-			return data, true
-		}
+func findValue(name string, a []*yaml.Node) (*yaml.Node, bool, error) {
+	index, err := findIndex(name, a)
+	if err != nil || index < 0 {
+		return nil, false, err
 	}
 
-	return nil, false
+	return a[index], true, nil
 }
 
-func findIndex(name string, a []interface{}) int {
+func findIndex(name string, a []*yaml.Node) (int, error) {
 	for i, data := range a {
-		c := interfaceToMapStringInterface(data)
-		if c["name"].(string) == name {
-			return i
+		n, err := getName(data)
+		if err != nil {
+			return -1, err
+		}
+		if n == name {
+			return i, nil
 		}
 	}
 
-	return -1
-}
-
-func valuesSame(v1 interface{}, v2 interface{}) bool {
-	return reflect.DeepEqual(v1, v2)
+	return -1, nil
 }
@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"testing"
 
-	yaml "gopkg.in/yaml.v2"
+	yaml "go.yaml.in/yaml/v3"
 )
 
 func TestTransformIssue(t *testing.T) {
@@ -17,71 +17,71 @@ merge:
 	args := make(map[string]interface{})
 	expectedPipeline := `
 groups:
-- jobs:
+- name: blah
+  jobs:
   - job1
   - job2
   - job3
-  name: blah
-- jobs:
+- name: blah_de_blah
+  jobs:
   - job1
-  name: blah_de_blah
-- jobs:
+- name: All
+  jobs:
   - job3
-  name: All
 jobs:
 - name: deploy1
+  serial: true
   plan:
-  - config:
+  - task: task1
+    config:
+      platform: linux
       image_resource:
+        type: docker-image
         source:
           repository: test/docker-container
-        type: docker-image
-      platform: linux
       run:
+        path: /bin/bash
         args:
         - -cel
         - |
           echo Hello World!
-        path: /bin/bash
-    task: task1
-  serial: true
 - name: deploy2
+  serial: true
   plan:
-  - config:
+  - task: task1
+    config:
+      platform: linux
       image_resource:
+        type: docker-image
         source:
           repository: test/docker-container
-        type: docker-image
-      platform: linux
       run:
+        path: /bin/bash
         args:
         - -cel
         - |
           echo Hello World!
-        path: /bin/bash
-    task: task1
-  serial: true
 - name: deploy3
+  serial: true
   plan:
-  - config:
+  - task: task1
+    config:
+      platform: linux
       image_resource:
+        type: docker-image
         source:
           repository: test/docker-container
-        type: docker-image
-      platform: linux
       run:
+        path: /bin/bash
         args:
         - -cel
         - |
           echo Hello World!
-        path: /bin/bash
-    task: task1
-  serial: true
 `
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -93,7 +93,7 @@ jobs:
 	result := transformedPipeline.String()
 
 	fmt.Println(result)
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
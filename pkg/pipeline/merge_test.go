@@ -3,7 +3,7 @@ package pipeline
 import (
 	"testing"
 
-	yaml "gopkg.in/yaml.v2"
+	yaml "go.yaml.in/yaml/v3"
 )
 
 func TestMergeSimple(t *testing.T) {
@@ -29,7 +29,7 @@ merge:
 	yaml.Unmarshal([]byte(e1), &ep)
 	expected, _ := yaml.Marshal(&ep)
 
-	result, _ := merge(p1, p2)
+	result, _ := mergeWithStrategy(p1, p2, "")
 	merged, _ := yaml.Marshal(&result)
 	if string(merged) != string(expected) {
 		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
@@ -63,7 +63,7 @@ resources:
 	yaml.Unmarshal([]byte(e1), &ep)
 	expected, _ := yaml.Marshal(&ep)
 
-	result, _ := merge(p1, p2)
+	result, _ := mergeWithStrategy(p1, p2, "")
 	merged, _ := yaml.Marshal(&result)
 	if string(merged) != string(expected) {
 		t.Errorf("[%v] is not equal to [%v]\n", string(merged), string(expected))
@@ -95,7 +95,7 @@ resources:
 	yaml.Unmarshal([]byte(e1), &ep)
 	expected, _ := yaml.Marshal(&ep)
 
-	result, _ := merge(p1, p2)
+	result, _ := mergeWithStrategy(p1, p2, "")
 	merged, _ := yaml.Marshal(&result)
 	if string(merged) != string(expected) {
 		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
@@ -119,7 +119,7 @@ resources:
 	yaml.Unmarshal([]byte(y1), &p1)
 	yaml.Unmarshal([]byte(y2), &p2)
 
-	_, ok := merge(p1, p2)
+	_, ok := mergeWithStrategy(p1, p2, "")
 	if ok == nil {
 		t.Errorf("Merging 2 resources with same name that are different should fail; %v", ok)
 	}
@@ -156,7 +156,7 @@ groups:
 	yaml.Unmarshal([]byte(e1), &ep)
 	expected, _ := yaml.Marshal(&ep)
 
-	result, _ := merge(p1, p2)
+	result, _ := mergeWithStrategy(p1, p2, "")
 	merged, _ := yaml.Marshal(&result)
 	if string(merged) != string(expected) {
 		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
@@ -192,13 +192,48 @@ groups:
 	yaml.Unmarshal([]byte(e1), &ep)
 	expected, _ := yaml.Marshal(&ep)
 
-	result, _ := merge(p1, p2)
+	result, _ := mergeWithStrategy(p1, p2, "")
 	merged, _ := yaml.Marshal(&result)
 	if string(merged) != string(expected) {
 		t.Errorf("[%v] is not equal to [%v]\n", result.String(), string(expected))
 	}
 }
 
+func TestMergeGroupsWithoutJobs(t *testing.T) {
+	y1 := `
+groups:
+- name: blah
+  jobs:
+  - job1
+`
+	y2 := `
+groups:
+- name: blah
+`
+	var p1 Pipeline
+	var p2 Pipeline
+
+	yaml.Unmarshal([]byte(y1), &p1)
+	yaml.Unmarshal([]byte(y2), &p2)
+
+	result, err := mergeWithStrategy(p1, p2, "")
+	if err != nil {
+		t.Fatalf("Error merging groups: %v", err)
+	}
+	merged, err := result.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling pipeline: %v", err)
+	}
+	expected := `groups:
+- name: blah
+  jobs:
+  - job1
+`
+	if merged != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", merged, expected)
+	}
+}
+
 func TestMergeGroupsWithOverlappingGroupNamesAndJobs(t *testing.T) {
 	y1 := `
 groups:
@@ -234,9 +269,94 @@ groups:
 	yaml.Unmarshal([]byte(e1), &ep)
 	expected, _ := yaml.Marshal(&ep)
 
-	result, _ := merge(p1, p2)
+	result, _ := mergeWithStrategy(p1, p2, "")
 	merged, _ := yaml.Marshal(&result)
 	if string(merged) != string(expected) {
 		t.Errorf("[%v] is not equal to [%v]\n", result.String(), string(expected))
 	}
 }
+
+func TestMergeStrategies(t *testing.T) {
+	y1 := `
+resources:
+- name: repo
+  type: git
+  source:
+    uri: git@github.com:finbourne/uav.git
+    branch: master
+jobs:
+- name: build
+  plan:
+  - get: repo
+`
+	y2 := `
+resources:
+- name: repo
+  type: git
+  source:
+    branch: develop
+    tag_filter: v*
+jobs:
+- name: build
+  plan:
+  - get: repo
+    trigger: true
+`
+	tests := []struct {
+		strategy Strategy
+		expected string
+	}{
+		{
+			strategy: StrategyFirstWins,
+			expected: y1,
+		},
+		{
+			strategy: StrategyLastWins,
+			expected: y2,
+		},
+		{
+			strategy: StrategyDeepMerge,
+			expected: `
+resources:
+- name: repo
+  type: git
+  source:
+    uri: git@github.com:finbourne/uav.git
+    branch: develop
+    tag_filter: v*
+jobs:
+- name: build
+  plan:
+  - get: repo
+    trigger: true
+`,
+		},
+	}
+
+	for _, test := range tests {
+		var p1 Pipeline
+		var p2 Pipeline
+		var ep Pipeline
+
+		yaml.Unmarshal([]byte(y1), &p1)
+		yaml.Unmarshal([]byte(y2), &p2)
+		yaml.Unmarshal([]byte(test.expected), &ep)
+
+		result, err := mergeWithStrategy(p1, p2, test.strategy)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.strategy, err)
+			continue
+		}
+		if result.String() != ep.String() {
+			t.Errorf("%s: [%v] is not equal to [%v]\n", test.strategy, result.String(), ep.String())
+		}
+	}
+
+	var p1 Pipeline
+	var p2 Pipeline
+	yaml.Unmarshal([]byte(y1), &p1)
+	yaml.Unmarshal([]byte(y2), &p2)
+	if _, err := mergeWithStrategy(p1, p2, StrategyError); err == nil {
+		t.Errorf("Merging 2 jobs with same name that are different should fail with the error strategy")
+	}
+}
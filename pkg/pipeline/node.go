@@ -0,0 +1,359 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// Pipeline objects are held as yaml.v3 nodes rather than decoded Go values so
+// that the key order and comments of the templates they came from survive
+// through to the output.
+
+// list returns the field of p holding the objects under a top-level key, or
+// nil if key is not one UAV understands.
+func (p *Pipeline) list(key string) *[]*yaml.Node {
+	switch key {
+	case "merge":
+		return &p.Merge
+	case "groups":
+		return &p.Groups
+	case "var_sources":
+		return &p.VarSources
+	case "resources":
+		return &p.Resources
+	case "resource_types":
+		return &p.ResourceTypes
+	case "jobs":
+		return &p.Jobs
+	}
+	return nil
+}
+
+// pipelineKeys are the top-level list keys of a pipeline, in the order they
+// are written out. `display` follows them.
+var pipelineKeys = []string{"merge", "groups", "var_sources", "resources", "resource_types", "jobs"}
+
+// unmarshalPipeline reads the pipeline document data into p. Unlike
+// yaml.Unmarshal it keeps the comments of the document itself, which
+// UnmarshalYAML is not given.
+func unmarshalPipeline(data []byte, p *Pipeline) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind != yaml.DocumentNode {
+		return nil
+	}
+	if err := doc.Decode(p); err != nil {
+		return err
+	}
+	p.headComment, p.footComment = doc.HeadComment, doc.FootComment
+	return nil
+}
+
+// UnmarshalYAML reads a pipeline document, keeping each object as a node.
+// Aliases are expanded so that objects remain valid wherever they are merged
+// to. Top-level keys UAV does not understand are recorded for checkKeys.
+func (p *Pipeline) UnmarshalYAML(value *yaml.Node) error {
+	if isNull(value) {
+		return nil
+	}
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: pipeline should be a map", value.Line)
+	}
+
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, val := value.Content[i], value.Content[i+1]
+		switch key.Value {
+		case "uav":
+			continue
+		case "display":
+			if !isNull(val) && val.Kind != yaml.MappingNode {
+				return fmt.Errorf("line %d: display should be a map", val.Line)
+			}
+			p.Display = expandAliases(val)
+			p.keepKey(key)
+			continue
+		}
+		dest := p.list(key.Value)
+		if dest == nil {
+			p.unknownKeys = append(p.unknownKeys, key)
+			continue
+		}
+		p.keepKey(key)
+		if isNull(val) {
+			continue
+		}
+		if val.Kind != yaml.SequenceNode {
+			return fmt.Errorf("line %d: %s should be a list", val.Line, key.Value)
+		}
+		*dest = expandAliases(val).Content
+	}
+	return nil
+}
+
+// keepKey records a top-level key node so that its comments are written out.
+func (p *Pipeline) keepKey(key *yaml.Node) {
+	if key.HeadComment == "" && key.LineComment == "" && key.FootComment == "" {
+		return
+	}
+	if p.keys == nil {
+		p.keys = map[string]*yaml.Node{}
+	}
+	p.keys[key.Value] = key
+}
+
+// mergeKeys returns the top-level key nodes of a merged pipeline: those of
+// existing, and those of incoming for keys existing was not read with.
+func mergeKeys(existing, incoming map[string]*yaml.Node) map[string]*yaml.Node {
+	if len(incoming) == 0 {
+		return existing
+	}
+	out := make(map[string]*yaml.Node, len(existing)+len(incoming))
+	for k, v := range incoming {
+		out[k] = v
+	}
+	for k, v := range existing {
+		out[k] = v
+	}
+	return out
+}
+
+// MarshalYAML writes the pipeline's objects under their top-level keys,
+// with the comments of the keys they were read from.
+func (p *Pipeline) MarshalYAML() (interface{}, error) {
+	out := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, key := range pipelineKeys {
+		items := *p.list(key)
+		if len(items) == 0 {
+			continue
+		}
+		out.Content = append(out.Content,
+			p.keyNode(key),
+			&yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: items})
+	}
+	if !isNull(p.Display) {
+		out.Content = append(out.Content, p.keyNode("display"), p.Display)
+	}
+	return out, nil
+}
+
+// document returns the pipeline as a YAML document with the comments of the
+// document it was read from.
+func (p *Pipeline) document() *yaml.Node {
+	content, _ := p.MarshalYAML()
+	return &yaml.Node{
+		Kind:        yaml.DocumentNode,
+		HeadComment: p.headComment,
+		FootComment: p.footComment,
+		Content:     []*yaml.Node{content.(*yaml.Node)},
+	}
+}
+
+// keyNode returns the node for the top-level key, with the comments it was
+// read with.
+func (p *Pipeline) keyNode(key string) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	if k, ok := p.keys[key]; ok {
+		n.HeadComment, n.LineComment, n.FootComment = k.HeadComment, k.LineComment, k.FootComment
+	}
+	return n
+}
+
+// checkKeys reports the top-level keys of p, rendered from the template
+// name, which UAV does not understand. They are an error under
+// WithStrictKeys, and otherwise recorded as warnings.
+func (p *Pipeline) checkKeys(name string, o *options) error {
+	for _, key := range p.unknownKeys {
+		if o != nil && o.strictKeys {
+			return &YAMLError{Name: name, Err: fmt.Errorf("line %d: unknown top-level key %q", key.Line, key.Value)}
+		}
+		p.warnings = append(p.warnings, fmt.Sprintf("%s:%d: unknown top-level key %q ignored", name, key.Line, key.Value))
+	}
+	return nil
+}
+
+// marshalYaml encodes v with the two space, compact sequence indent used for
+// all output.
+func marshalYaml(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	encoder.CompactSeqIndent()
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func isNull(n *yaml.Node) bool {
+	return n == nil || (n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null")
+}
+
+// expandAliases returns a deep copy of n with every alias replaced by a copy
+// of the node it refers to, merge keys (`<<`) flattened into their mapping,
+// and anchors removed.
+func expandAliases(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		return expandAliases(n.Alias)
+	}
+
+	c := *n
+	c.Anchor = ""
+	c.Content = make([]*yaml.Node, 0, len(n.Content))
+	if n.Kind != yaml.MappingNode {
+		for _, child := range n.Content {
+			c.Content = append(c.Content, expandAliases(child))
+		}
+		return &c
+	}
+
+	var merged []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Kind == yaml.ScalarNode && key.ShortTag() == "!!merge" {
+			value = expandAliases(value)
+			if value.Kind == yaml.SequenceNode {
+				merged = append(merged, value.Content...)
+			} else {
+				merged = append(merged, value)
+			}
+			continue
+		}
+		c.Content = append(c.Content, expandAliases(key), expandAliases(value))
+	}
+
+	// Explicit keys take precedence over merged ones, and earlier merged
+	// mappings over later ones.
+	for _, m := range merged {
+		for i := 0; m.Kind == yaml.MappingNode && i+1 < len(m.Content); i += 2 {
+			if mappingValue(&c, m.Content[i].Value) == nil {
+				c.Content = append(c.Content, m.Content[i], m.Content[i+1])
+			}
+		}
+	}
+	return &c
+}
+
+// copyNode returns a deep copy of n.
+func copyNode(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		c.Content[i] = copyNode(child)
+	}
+	return &c
+}
+
+// mappingValue returns the value of key in the mapping n, or nil if n is not
+// a mapping or has no such key.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue replaces the value of key in the mapping n, appending the
+// key if it is not present.
+func setMappingValue(n *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content[i+1] = value
+			return
+		}
+	}
+	n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// scalarValue returns the value of a scalar node.
+func scalarValue(n *yaml.Node) (string, bool) {
+	if n == nil || n.Kind != yaml.ScalarNode || isNull(n) {
+		return "", false
+	}
+	return n.Value, true
+}
+
+// sequenceItems returns the items of a sequence node, or nil if n is not a
+// sequence.
+func sequenceItems(n *yaml.Node) []*yaml.Node {
+	if n == nil || n.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return n.Content
+}
+
+// decodeNode converts n to plain Go values, e.g. for use as template data.
+func decodeNode(n *yaml.Node) (interface{}, error) {
+	if n == nil {
+		return nil, nil
+	}
+	var v interface{}
+	if err := n.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// nodesEqual reports whether a and b hold the same data, regardless of
+// comments, formatting or mapping key order.
+func nodesEqual(a *yaml.Node, b *yaml.Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Kind != b.Kind {
+		return false
+	}
+
+	switch a.Kind {
+	case yaml.ScalarNode:
+		if a.ShortTag() != b.ShortTag() {
+			return false
+		}
+		if a.Value == b.Value {
+			return true
+		}
+		av, aErr := decodeNode(a)
+		bv, bErr := decodeNode(b)
+		return aErr == nil && bErr == nil && reflect.DeepEqual(av, bv)
+	case yaml.MappingNode:
+		if len(a.Content) != len(b.Content) {
+			return false
+		}
+		for i := 0; i+1 < len(a.Content); i += 2 {
+			if !nodesEqual(a.Content[i+1], mappingValue(b, a.Content[i].Value)) {
+				return false
+			}
+		}
+		return true
+	case yaml.AliasNode:
+		return nodesEqual(a.Alias, b.Alias)
+	}
+
+	if len(a.Content) != len(b.Content) {
+		return false
+	}
+	for i := range a.Content {
+		if !nodesEqual(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
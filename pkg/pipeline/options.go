@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"text/template"
+
+	"github.com/finbourne/uav/pkg/log"
+)
+
+// Option configures how a Pipeline is rendered and transformed.
+type Option func(*options)
+
+type options struct {
+	maxDepth      int
+	resolution    Resolution
+	pipelineFile  string
+	templateRoots []string
+	strictKeys    bool
+	env           *envPolicy
+	onRead        func(path string)
+	trace         *Trace
+	sort          SortOrder
+	groupRules    []GroupRule
+	allGroup      string
+	strategy      Strategy
+	funcs         template.FuncMap
+	log           Logger
+	fs            fs.FS
+	jobs          int
+}
+
+// Resolution selects how `merge:` template paths are resolved.
+type Resolution string
+
+// Resolution modes. ResolveWorkingDir reads paths relative to the process's
+// working directory. ResolveRelative reads them relative to the directory of
+// the file containing the `merge:` entry, then relative to the directory of
+// the root pipeline. Both fall back to the template index.
+const (
+	ResolveWorkingDir Resolution = "cwd"
+	ResolveRelative   Resolution = "relative"
+)
+
+// ParseResolution validates a resolution mode name.
+func ParseResolution(name string) (Resolution, error) {
+	switch r := Resolution(name); r {
+	case ResolveWorkingDir, ResolveRelative:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown template resolution %q, expected %q or %q", name, ResolveWorkingDir, ResolveRelative)
+}
+
+// tracer returns the trace set with WithTrace, or nil.
+func (o *options) tracer() *Trace {
+	if o == nil {
+		return nil
+	}
+	return o.trace
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithMaxMergeDepth limits how deeply `merge:` entries may nest below the root
+// pipeline. A depth of zero or less means no limit.
+func WithMaxMergeDepth(depth int) Option {
+	return func(o *options) {
+		o.maxDepth = depth
+	}
+}
+
+// WithResolution sets how `merge:` template paths are resolved, overriding
+// any `uav: {resolve: ...}` setting in the pipeline itself.
+func WithResolution(resolution Resolution) Option {
+	return func(o *options) {
+		o.resolution = resolution
+	}
+}
+
+// WithPipelineFile records the file the pipeline was read from. It is used
+// to name the root pipeline in errors and as the pipeline root directory for
+// ResolveRelative.
+func WithPipelineFile(path string) Option {
+	return func(o *options) {
+		o.pipelineFile = path
+	}
+}
+
+// rootDir returns the directory relative `merge:` paths fall back to.
+func (o *options) rootDir() string {
+	if o == nil || o.pipelineFile == "" {
+		return "."
+	}
+	return filepath.Dir(o.pipelineFile)
+}
+
+// WithTemplateRoots names the directories templates were collected from.
+// Templates under a root can be referred to by their path relative to it,
+// e.g. `slack/on_failure.tpl`, as well as by their basename.
+func WithTemplateRoots(roots ...string) Option {
+	return func(o *options) {
+		o.templateRoots = roots
+	}
+}
+
+// envPolicy returns the environment allow-list, or nil if templates have
+// unrestricted access.
+func (o *options) envPolicy() *envPolicy {
+	if o == nil {
+		return nil
+	}
+	return o.env
+}
+
+// WithStrictKeys makes top-level pipeline keys UAV does not understand an
+// error, rather than a warning.
+func WithStrictKeys(strict bool) Option {
+	return func(o *options) {
+		o.strictKeys = strict
+	}
+}
+
+// WithEnv exposes the environment variables starting with one of prefixes, or
+// named in names, to every template as the fields of `.Env`. It also restricts
+// the `env` and `expandenv` template functions to those variables. Without
+// this option templates have unrestricted access via those functions, and no
+// `.Env`.
+func WithEnv(prefixes []string, names []string) Option {
+	return func(o *options) {
+		if len(prefixes) == 0 && len(names) == 0 {
+			o.env = nil
+			return
+		}
+		o.env = &envPolicy{prefixes: prefixes, names: names}
+	}
+}
+
+// WithReadObserver calls fn with the path of every template file read through
+// a `merge:` entry, including those read before transformation fails, e.g. to
+// watch them for changes.
+func WithReadObserver(fn func(path string)) Option {
+	return func(o *options) {
+		o.onRead = fn
+	}
+}
+
+// WithDefaultStrategy sets the strategy used by `merge:` entries which do not
+// set one themselves.
+func WithDefaultStrategy(s Strategy) Option {
+	return func(o *options) {
+		o.strategy = s
+	}
+}
+
+// defaultStrategy returns the strategy set with WithDefaultStrategy, or "".
+func (o *options) defaultStrategy() Strategy {
+	if o == nil {
+		return ""
+	}
+	return o.strategy
+}
+
+// WithFuncs makes funcs available to every template, alongside, and
+// overriding, Sprig's functions and UAV's own. They cannot override the `env`
+// and `expandenv` functions restricted by WithEnv.
+func WithFuncs(funcs template.FuncMap) Option {
+	return func(o *options) {
+		if o.funcs == nil {
+			o.funcs = template.FuncMap{}
+		}
+		for name, fn := range funcs {
+			o.funcs[name] = fn
+		}
+	}
+}
+
+// customFuncs returns the functions set with WithFuncs.
+func (o *options) customFuncs() template.FuncMap {
+	if o == nil {
+		return nil
+	}
+	return o.funcs
+}
+
+// Logger receives the messages logged while a pipeline is transformed.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger logs through the log package.
+type stdLogger struct{}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Infof(format, args...)
+}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Errorf(format, args...)
+}
+
+// WithLogger sends the messages logged while the pipeline is transformed to
+// l, rather than to the log package.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.log = l
+	}
+}
+
+// logger returns the logger set with WithLogger, or one logging through the
+// log package.
+func (o *options) logger() Logger {
+	if o == nil || o.log == nil {
+		return stdLogger{}
+	}
+	return o.log
+}
@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// WithJobs renders up to n `merge:` templates of the same level at once.
+// Templates are still merged one at a time in the order of their entries, so
+// the result does not depend on n. Funcs passed with WithFuncs must then be
+// safe for concurrent use. A value of one or less renders one at a time.
+func WithJobs(n int) Option {
+	return func(o *options) {
+		o.jobs = n
+	}
+}
+
+// concurrency returns the number of templates to render at once.
+func (o *options) concurrency() int {
+	if o == nil || o.jobs < 1 {
+		return 1
+	}
+	return o.jobs
+}
+
+// pendingMerge is a `merge:` entry of the level being transformed, and the
+// result of rendering it.
+type pendingMerge struct {
+	mc     mergeConfig
+	source *mergeSource // the pipeline containing the entry
+	frame  *mergeSource // the template the entry merges
+	err    error        // the entry itself is malformed
+
+	out       Pipeline
+	renderErr error
+}
+
+// mergeEntries reads the `merge:` entries of p in order, up to and including
+// the first malformed one. Entries without a template are skipped.
+func (p *Pipeline) mergeEntries() []*pendingMerge {
+	var entries []*pendingMerge
+	for i, v := range p.Merge {
+		source := p.mergeSource(i)
+		mc, ok, err := mergeConfigFromTemplateWithParams(v)
+		if err != nil {
+			return append(entries, &pendingMerge{source: source, err: err})
+		}
+		if !ok {
+			continue
+		}
+
+		if mc.Strategy == "" {
+			mc.Strategy = p.opts.defaultStrategy()
+		}
+		frame := &mergeSource{frame: MergeFrame{Template: mc.FilePath, Args: mc.Parameters}, parent: source}
+		entries = append(entries, &pendingMerge{mc: mc, source: source, frame: frame})
+	}
+	return entries
+}
+
+// renderMergeEntries renders the templates of entries, up to the first
+// malformed entry, on at most p.opts.concurrency() goroutines. Rendered one
+// at a time, it stops at the first template which fails, as merging would.
+// Otherwise every template is rendered, so that the failure reported is that
+// of the first entry however the work was scheduled.
+func (p *Pipeline) renderMergeEntries(ctx context.Context, entries []*pendingMerge) {
+	jobs := p.opts.concurrency()
+	if jobs == 1 {
+		for _, e := range entries {
+			if e.err != nil {
+				return
+			}
+			e.out, e.renderErr = p.renderMergeConfig(ctx, e.mc, e.frame)
+			if e.renderErr != nil {
+				return
+			}
+		}
+		return
+	}
+
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		if e.err != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(e *pendingMerge) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			e.out, e.renderErr = p.renderMergeConfig(ctx, e.mc, e.frame)
+		}(e)
+	}
+	wg.Wait()
+}
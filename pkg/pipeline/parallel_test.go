@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// syntheticPipeline returns a pipeline of n `merge:` entries, each rendering
+// a job of steps steps which merges a resource template in turn, and the
+// file system holding its templates.
+func syntheticPipeline(n, steps int) (string, fstest.MapFS, []string) {
+	fsys := fstest.MapFS{
+		"job.yml": {Data: []byte(`
+resources:
+- name: repo-{{ .name }}
+  type: git
+  source:
+    uri: https://example.com/{{ .name }}.git
+jobs:
+- name: {{ .name }}
+  plan:
+  - get: repo-{{ .name }}
+{{- range $i := until .steps }}
+  - task: step-{{ $i }}
+    {{- include "step.tpl" (dict "name" $.name "step" $i) | nindent 4 }}
+{{- end }}
+merge:
+- template: notify.yml
+  args:
+    name: {{ .name }}
+`)},
+		"step.tpl": {Data: []byte(`file: repo-{{ .name }}/ci/{{ .step }}.yml
+params:
+  CHECKSUM: {{ printf "%s-%d" .name .step | sha256sum }}`)},
+		"notify.yml": {Data: []byte(`
+resource_types:
+- name: slack
+  type: registry-image
+  source:
+    repository: example/slack
+resources:
+- name: notify-{{ .name }}
+  type: slack
+`)},
+	}
+
+	var b strings.Builder
+	b.WriteString("merge:\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "- template: job.yml\n  args:\n    name: job-%03d\n    steps: %d\n", i, steps)
+	}
+	return b.String(), fsys, []string{"job.yml", "step.tpl", "notify.yml"}
+}
+
+func transformSynthetic(p string, fsys fstest.MapFS, templates []string, jobs int) (*Pipeline, error) {
+	merger, err := NewPipeline(p, nil, templates, WithFS(fsys), WithJobs(jobs))
+	if err != nil {
+		return nil, err
+	}
+	return merger.Transform()
+}
+
+func TestTransformJobsDeterministic(t *testing.T) {
+	p, fsys, templates := syntheticPipeline(40, 5)
+	pipeline, err := transformSynthetic(p, fsys, templates, 1)
+	if err != nil {
+		t.Fatalf("Error transforming pipeline: %v", err)
+	}
+	expected := pipeline.String()
+
+	for _, jobs := range []int{2, 8, 64} {
+		for run := 0; run < 5; run++ {
+			pipeline, err := transformSynthetic(p, fsys, templates, jobs)
+			if err != nil {
+				t.Fatalf("Error transforming pipeline with %d jobs: %v", jobs, err)
+			}
+			if result := pipeline.String(); result != expected {
+				t.Fatalf("Output with %d jobs differs from output with one:\n%s", jobs, result)
+			}
+		}
+	}
+}
+
+func TestTransformJobsFirstError(t *testing.T) {
+	fsys := fstest.MapFS{
+		"ok.yml":     {Data: []byte("jobs:\n- name: ok\n  plan: []\n")},
+		"first.yml":  {Data: []byte(`{{ fail "first" }}`)},
+		"second.yml": {Data: []byte(`{{ fail "second" }}`)},
+	}
+	p := `
+merge:
+- template: ok.yml
+- template: first.yml
+- template: second.yml
+`
+	for run := 0; run < 10; run++ {
+		merger, err := NewPipeline(p, nil, nil, WithFS(fsys), WithJobs(3))
+		if err != nil {
+			t.Fatalf("Error creating pipeline: %v", err)
+		}
+		_, err = merger.Transform()
+		var pe *PipelineError
+		if !errors.As(err, &pe) || pe.File != "first.yml" {
+			t.Fatalf("Expected first.yml's error to be reported, got %v", err)
+		}
+	}
+}
+
+func BenchmarkTransform(b *testing.B) {
+	p, fsys, templates := syntheticPipeline(100, 200)
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := transformSynthetic(p, fsys, templates, jobs); err != nil {
+					b.Fatalf("Error transforming pipeline: %v", err)
+				}
+			}
+		})
+	}
+}
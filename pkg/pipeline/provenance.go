@@ -0,0 +1,208 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// Provenance records the template which introduced an object of a
+// transformed pipeline. Chain lists the `merge:` entries, root pipeline
+// first, that led to Template. Steps is set for jobs, and records the same
+// for each step of the job's plan, which may come from a different template
+// when jobs are merged with the `extend` strategy. A group generated from a
+// group rule or as the all group has no template; Generated describes how it
+// was generated instead.
+type Provenance struct {
+	Kind      string           `json:"kind"`
+	Name      string           `json:"name,omitempty"`
+	Template  string           `json:"template,omitempty"`
+	Chain     []MergeFrame     `json:"chain,omitempty"`
+	Generated string           `json:"generated,omitempty"`
+	Steps     []StepProvenance `json:"steps,omitempty"`
+}
+
+// StepProvenance records the template which introduced the Index'th step of
+// a job's plan.
+type StepProvenance struct {
+	Index    int          `json:"index"`
+	Template string       `json:"template"`
+	Chain    []MergeFrame `json:"chain"`
+}
+
+// Provenance returns the provenance of every group, var source, resource,
+// resource type and job, in output order, followed by that of `display` if
+// the pipeline has one.
+func (p *Pipeline) Provenance() []Provenance {
+	var out []Provenance
+	for _, l := range p.objectLists() {
+		for _, item := range l.items {
+			name, err := getName(item)
+			if err != nil {
+				continue
+			}
+			if reason, ok := p.generatedGroup(l.kind, name); ok {
+				out = append(out, Provenance{Kind: l.kind, Name: name, Generated: reason})
+				continue
+			}
+			source := p.origin(l.kind, name)
+			prov := Provenance{Kind: l.kind, Name: name, Template: source.template(), Chain: source.chain()}
+			if l.kind == kindJob {
+				for i, step := range planSteps(item) {
+					s := p.stepOrigin(step)
+					prov.Steps = append(prov.Steps, StepProvenance{Index: i, Template: s.template(), Chain: s.chain()})
+				}
+			}
+			out = append(out, prov)
+		}
+	}
+	if !isNull(p.Display) {
+		source := p.origin(kindDisplay, "")
+		out = append(out, Provenance{Kind: kindDisplay, Template: source.template(), Chain: source.chain()})
+	}
+	return out
+}
+
+// MarshalWithProvenance returns the pipeline as YAML, as Marshal does, with
+// a comment before every object naming the template which introduced it.
+// Plan steps introduced by a different template to their job are annotated
+// too.
+func (p *Pipeline) MarshalWithProvenance() (string, error) {
+	annotated := *p
+	lists := map[string]*[]*yaml.Node{
+		kindGroup:        &annotated.Groups,
+		kindVarSource:    &annotated.VarSources,
+		kindResource:     &annotated.Resources,
+		kindResourceType: &annotated.ResourceTypes,
+		kindJob:          &annotated.Jobs,
+	}
+	for _, l := range p.objectLists() {
+		items := make([]*yaml.Node, len(l.items))
+		for i, item := range l.items {
+			items[i] = item
+			name, err := getName(item)
+			if err != nil {
+				continue
+			}
+			if reason, ok := p.generatedGroup(l.kind, name); ok {
+				items[i] = annotate(item, "generated: "+reason)
+				continue
+			}
+			source := p.origin(l.kind, name)
+			items[i] = annotate(item, provenanceComment(source))
+			if l.kind != kindJob {
+				continue
+			}
+
+			plan := mappingValue(items[i], "plan")
+			for j, step := range planSteps(item) {
+				if s := p.stepOrigin(step); s != source {
+					plan.Content[j] = annotate(step, provenanceComment(s))
+				}
+			}
+		}
+		*lists[l.kind] = items
+	}
+	if !isNull(p.Display) {
+		key := annotate(p.keyNode("display"), provenanceComment(p.origin(kindDisplay, "")))
+		annotated.keys = mergeKeys(map[string]*yaml.Node{"display": key}, p.keys)
+	}
+	return annotated.Marshal()
+}
+
+// annotate returns a copy of n with the comment text before it.
+func annotate(n *yaml.Node, text string) *yaml.Node {
+	c := copyNode(n)
+	comment := "# " + text
+	if c.HeadComment != "" {
+		comment += "\n" + c.HeadComment
+	}
+	c.HeadComment = comment
+	return c
+}
+
+// generatedGroup returns how the named object was generated, if it is a
+// group generated from a rule or as the all group.
+func (p *Pipeline) generatedGroup(kind string, name string) (string, bool) {
+	if kind != kindGroup {
+		return "", false
+	}
+	reason, ok := p.generated[name]
+	return reason, ok
+}
+
+func provenanceComment(source *mergeSource) string {
+	chain := source.chain()
+	if len(chain) <= 1 {
+		return fmt.Sprintf("from: %s", source.template())
+	}
+	templates := make([]string, len(chain))
+	for i, f := range chain {
+		templates[i] = f.Template
+	}
+	return fmt.Sprintf("from: %s (merge chain: %s)", source.template(), strings.Join(templates, " -> "))
+}
+
+// objectLists returns the pipeline's lists of named objects in output order.
+func (p *Pipeline) objectLists() []struct {
+	kind  string
+	items []*yaml.Node
+} {
+	return []struct {
+		kind  string
+		items []*yaml.Node
+	}{
+		{kindGroup, p.Groups},
+		{kindVarSource, p.VarSources},
+		{kindResource, p.Resources},
+		{kindResourceType, p.ResourceTypes},
+		{kindJob, p.Jobs},
+	}
+}
+
+// planSteps returns the steps of a job's plan.
+func planSteps(job *yaml.Node) []*yaml.Node {
+	return sequenceItems(mappingValue(job, "plan"))
+}
+
+// stepOrigin returns the template which introduced a plan step. Steps
+// without an origin came from the root pipeline.
+func (p *Pipeline) stepOrigin(step *yaml.Node) *mergeSource {
+	if s, ok := p.stepOrigins[step]; ok {
+		return s
+	}
+	return p.root
+}
+
+// mergeStepOrigins returns p1's step origins extended with the plan steps of
+// the sub-pipeline p2's jobs. Steps are recorded by node rather than by
+// position, since merging jobs with the `extend` strategy moves them. As with
+// mergeOrigins, p1's map is updated in place.
+func mergeStepOrigins(p1 Pipeline, p2 Pipeline) map[*yaml.Node]*mergeSource {
+	out := p1.stepOrigins
+	if out == nil {
+		out = map[*yaml.Node]*mergeSource{}
+	}
+	if p2.source == nil {
+		return out
+	}
+	for _, job := range p2.Jobs {
+		for _, step := range planSteps(job) {
+			if _, ok := out[step]; !ok {
+				out[step] = p2.source
+			}
+		}
+	}
+	return out
+}
+
+// copyStepOrigins returns a copy of origins, for a pipeline which will be
+// merged into.
+func copyStepOrigins(origins map[*yaml.Node]*mergeSource) map[*yaml.Node]*mergeSource {
+	out := make(map[*yaml.Node]*mergeSource, len(origins))
+	for k, v := range origins {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,187 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestProvenance(t *testing.T) {
+	p := `
+resources:
+- name: notify
+  type: slack-notification
+merge:
+- template: test.d/job_simple.yaml
+- template: test.d/job_extend.yaml
+  strategy: extend
+`
+	merger, err := NewPipeline(p, nil, nil, WithPipelineFile("pipeline.yml"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	prov := pipeline.Provenance()
+	if len(prov) != 2 {
+		t.Fatalf("Expected provenance for 2 objects, got %+v", prov)
+	}
+
+	resource := prov[0]
+	if resource.Kind != kindResource || resource.Name != "notify" || resource.Template != "pipeline.yml" || len(resource.Chain) != 1 {
+		t.Errorf("Unexpected resource provenance %+v", resource)
+	}
+
+	job := prov[1]
+	if job.Kind != kindJob || job.Name != "deploy" || job.Template != "test.d/job_extend.yaml" {
+		t.Errorf("Unexpected job provenance %+v", job)
+	}
+	if len(job.Steps) != 2 {
+		t.Fatalf("Expected provenance for 2 steps, got %+v", job.Steps)
+	}
+	if job.Steps[0].Template != "test.d/job_simple.yaml" || len(job.Steps[0].Chain) != 2 || job.Steps[0].Chain[0].Template != "pipeline.yml" {
+		t.Errorf("Unexpected provenance for the first step %+v", job.Steps[0])
+	}
+	if job.Steps[1].Index != 1 || job.Steps[1].Template != "test.d/job_extend.yaml" {
+		t.Errorf("Unexpected provenance for the appended step %+v", job.Steps[1])
+	}
+}
+
+func TestMarshalWithProvenance(t *testing.T) {
+	p := `
+resources:
+- name: notify
+  type: slack-notification
+merge:
+- template: test.d/job_simple.yaml
+- template: test.d/job_extend.yaml
+  strategy: extend
+`
+	merger, err := NewPipeline(p, nil, nil, WithPipelineFile("pipeline.yml"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	out, err := pipeline.MarshalWithProvenance()
+	if err != nil {
+		t.Fatalf("Error marshalling pipeline: %v", err)
+	}
+	expected := []string{
+		"resources:\n# from: pipeline.yml\n- name: notify",
+		"jobs:\n# from: test.d/job_extend.yaml (merge chain: pipeline.yml -> test.d/job_extend.yaml)\n- name: deploy",
+		"  plan:\n  # from: test.d/job_simple.yaml (merge chain: pipeline.yml -> test.d/job_simple.yaml)\n  - task: task1",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected output to contain %q, got:\n%s", e, out)
+		}
+	}
+	if strings.Contains(out, "  # from: test.d/job_extend.yaml") {
+		t.Errorf("Expected steps from the job's own template not to be annotated, got:\n%s", out)
+	}
+
+	plain, err := pipeline.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling pipeline: %v", err)
+	}
+	if strings.Contains(plain, "# from:") {
+		t.Errorf("Expected Marshal not to be annotated, got:\n%s", plain)
+	}
+}
+
+func TestProvenanceGeneratedGroups(t *testing.T) {
+	fsys := fstest.MapFS{
+		"job.yml": {Data: []byte("jobs:\n- name: deploy\n  group: g1\n  plan: []\n")},
+	}
+	p := `
+groups:
+- name: existing
+  jobs: [deploy]
+merge:
+- template: job.yml
+`
+	rule, err := ParseGroupRule("deploys=^deploy")
+	if err != nil {
+		t.Fatalf("Error parsing group rule: %v", err)
+	}
+	merger, err := NewPipeline(p, nil, nil, WithFS(fsys), WithPipelineFile("pl.yml"), WithGroupRules(rule), WithAllGroup("all"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	expected := map[string]string{
+		"all":      "generated: all group",
+		"existing": "from: pl.yml",
+		"g1":       "from: job.yml (merge chain: pl.yml -> job.yml)",
+		"deploys":  "generated: group rule deploys=^deploy",
+	}
+	var groups int
+	for _, prov := range pipeline.Provenance() {
+		if prov.Kind != kindGroup {
+			continue
+		}
+		groups++
+		got := "from: " + prov.Template
+		if prov.Generated != "" {
+			got = "generated: " + prov.Generated
+		} else if len(prov.Chain) > 1 {
+			got += " (merge chain: pl.yml -> job.yml)"
+		}
+		if got != expected[prov.Name] {
+			t.Errorf("Expected group %s to be %q, got %q", prov.Name, expected[prov.Name], got)
+		}
+	}
+	if groups != len(expected) {
+		t.Errorf("Expected provenance for %d groups, got %d", len(expected), groups)
+	}
+
+	out, err := pipeline.MarshalWithProvenance()
+	if err != nil {
+		t.Fatalf("Error marshalling pipeline: %v", err)
+	}
+	for name, comment := range expected {
+		if !strings.Contains(out, "# "+comment+"\n- name: "+name+"\n") {
+			t.Errorf("Expected group %s to be annotated %q in:\n%s", name, comment, out)
+		}
+	}
+}
+
+func TestProvenanceTransformTwice(t *testing.T) {
+	p := `
+merge:
+- template: test.d/job_simple.yaml
+- template: test.d/job_extend.yaml
+  strategy: extend
+`
+	merger, err := NewPipeline(p, nil, nil, WithPipelineFile("pipeline.yml"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		pipeline, err := merger.Transform()
+		if err != nil {
+			t.Fatalf("Error transforming %v: %v", p, err)
+		}
+		out, err := pipeline.MarshalWithProvenance()
+		if err != nil {
+			t.Fatalf("Error marshalling pipeline: %v", err)
+		}
+		outputs = append(outputs, out)
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("Expected the same provenance each time, got [%v] and [%v]", outputs[0], outputs[1])
+	}
+}
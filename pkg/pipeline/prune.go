@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// Unused finds the resources no job step gets or puts, and the resource types
+// not needed by a used resource, a task's `image_resource` or another needed
+// resource type. Templates bundling their dependencies tend to leave these
+// behind. Each is returned as a ValidationError, resources first, in
+// pipeline order.
+func (p *Pipeline) Unused() []ValidationError {
+	resources, resourceTypes := p.used()
+	v := validator{pipeline: p}
+	for _, resource := range p.Resources {
+		if name, err := getName(resource); err == nil && !resources[name] {
+			v.report(kindResource, name, "not used by any job")
+		}
+	}
+	for _, resourceType := range p.ResourceTypes {
+		if name, err := getName(resourceType); err == nil && !resourceTypes[name] {
+			v.report(kindResourceType, name, "not used by any resource or task")
+		}
+	}
+	return v.errors
+}
+
+// Prune removes the resources and resource types reported by Unused, and
+// returns what was removed.
+func (p *Pipeline) Prune() []ValidationError {
+	unused := p.Unused()
+	if len(unused) == 0 {
+		return nil
+	}
+
+	removed := make(map[objectKey]bool, len(unused))
+	for _, u := range unused {
+		removed[objectKey{u.Kind, u.Name}] = true
+	}
+	keep := func(kind string, items []*yaml.Node) []*yaml.Node {
+		var out []*yaml.Node
+		for _, item := range items {
+			if name, err := getName(item); err != nil || !removed[objectKey{kind, name}] {
+				out = append(out, item)
+			}
+		}
+		return out
+	}
+	p.Resources = keep(kindResource, p.Resources)
+	p.ResourceTypes = keep(kindResourceType, p.ResourceTypes)
+	return unused
+}
+
+// used returns the names of the resources used by job steps, and of the
+// resource types they, task images and those resource types in turn need.
+func (p *Pipeline) used() (resources map[string]bool, resourceTypes map[string]bool) {
+	resources = map[string]bool{}
+	var needed []string
+	for _, job := range p.Jobs {
+		forEachStep(job, func(step *yaml.Node) {
+			if _, _, resource, ok := stepResource(step); ok {
+				resources[resource] = true
+			}
+			image := mappingValue(mappingValue(step, "config"), "image_resource")
+			if t, ok := scalarValue(mappingValue(image, "type")); ok {
+				needed = append(needed, t)
+			}
+		})
+	}
+	for _, resource := range p.Resources {
+		if name, err := getName(resource); err == nil && resources[name] {
+			if t, ok := scalarValue(mappingValue(resource, "type")); ok {
+				needed = append(needed, t)
+			}
+		}
+	}
+
+	declared := map[string]*yaml.Node{}
+	for _, resourceType := range p.ResourceTypes {
+		if name, err := getName(resourceType); err == nil {
+			declared[name] = resourceType
+		}
+	}
+	resourceTypes = map[string]bool{}
+	for len(needed) > 0 {
+		t := needed[0]
+		needed = needed[1:]
+		if resourceTypes[t] {
+			continue
+		}
+		resourceTypes[t] = true
+		if parent, ok := scalarValue(mappingValue(declared[t], "type")); ok {
+			needed = append(needed, parent)
+		}
+	}
+	return resources, resourceTypes
+}
@@ -0,0 +1,85 @@
+package pipeline
+
+import (
+	"testing"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+func TestPrune(t *testing.T) {
+	y := `
+resource_types:
+- name: base
+  type: registry-image
+- name: slack-notification
+  type: base
+- name: pull-request
+  type: registry-image
+- name: builder
+  type: registry-image
+resources:
+- name: repo
+  type: git
+- name: notify
+  type: slack-notification
+- name: pr
+  type: pull-request
+jobs:
+- name: build
+  plan:
+  - get: source
+    resource: repo
+  - task: compile
+    config:
+      image_resource:
+        type: builder
+  on_failure:
+    put: notify
+`
+	expected := `
+resource_types:
+- name: base
+  type: registry-image
+- name: slack-notification
+  type: base
+- name: builder
+  type: registry-image
+resources:
+- name: repo
+  type: git
+- name: notify
+  type: slack-notification
+jobs:
+- name: build
+  plan:
+  - get: source
+    resource: repo
+  - task: compile
+    config:
+      image_resource:
+        type: builder
+  on_failure:
+    put: notify
+`
+	var p Pipeline
+	yaml.Unmarshal([]byte(y), &p)
+
+	unused := p.Unused()
+	if len(unused) != 2 || unused[0].Kind != kindResource || unused[0].Name != "pr" || unused[1].Kind != kindResourceType || unused[1].Name != "pull-request" {
+		t.Fatalf("Expected resource pr and resource type pull-request to be unused, got %v", unused)
+	}
+
+	removed := p.Prune()
+	if len(removed) != 2 {
+		t.Errorf("Expected 2 objects to be pruned, got %v", removed)
+	}
+	var e Pipeline
+	yaml.Unmarshal([]byte(expected), &e)
+	if p.String() != e.String() {
+		t.Errorf("Expected pruned pipeline:\n%s\ngot:\n%s", e.String(), p.String())
+	}
+
+	if unused := p.Unused(); len(unused) != 0 {
+		t.Errorf("Expected nothing unused after pruning, got %v", unused)
+	}
+}
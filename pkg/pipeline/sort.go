@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// SortOrder selects how the named objects of a transformed pipeline are
+// ordered.
+type SortOrder string
+
+// Sort orders. Without one, each template's resources, resource types and var
+// sources are placed before those already merged, while its jobs and groups
+// are placed after them. SortFirstSeen places every object in the order it
+// was first merged, the root pipeline's first. SortByName orders objects by
+// name, and SortByTypeThenName orders those with a `type`, i.e. resources,
+// resource types and var sources, by type and then by name.
+const (
+	SortFirstSeen      SortOrder = "preserve-first-seen"
+	SortByName         SortOrder = "by-name"
+	SortByTypeThenName SortOrder = "by-type-then-name"
+)
+
+// ParseSortOrder validates a sort order name.
+func ParseSortOrder(name string) (SortOrder, error) {
+	switch o := SortOrder(name); o {
+	case SortFirstSeen, SortByName, SortByTypeThenName:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown sort order %q, expected %q, %q or %q", name, SortFirstSeen, SortByName, SortByTypeThenName)
+}
+
+// WithSortOrder orders the jobs, resources, resource types, var sources and
+// groups of the transformed pipeline.
+func WithSortOrder(order SortOrder) Option {
+	return func(o *options) {
+		o.sort = order
+	}
+}
+
+// sortOrder returns the order set with WithSortOrder, or "".
+func (o *options) sortOrder() SortOrder {
+	if o == nil {
+		return ""
+	}
+	return o.sort
+}
+
+// sortObjects orders the pipeline's named objects by order. Merging has
+// already laid them out in first seen order if that was selected.
+func (p *Pipeline) sortObjects(order SortOrder) {
+	if order != SortByName && order != SortByTypeThenName {
+		return
+	}
+	byType := order == SortByTypeThenName
+	for _, items := range []*[]*yaml.Node{&p.Groups, &p.VarSources, &p.Resources, &p.ResourceTypes, &p.Jobs} {
+		*items = sortNamed(*items, byType)
+	}
+}
+
+// sortNamed returns items ordered by name, or by type and then name. Items
+// with the same key keep their order.
+func sortNamed(items []*yaml.Node, byType bool) []*yaml.Node {
+	type keyed struct {
+		typ, name string
+		node      *yaml.Node
+	}
+	keys := make([]keyed, len(items))
+	for i, item := range items {
+		keys[i].node = item
+		keys[i].name, _ = getName(item)
+		if byType {
+			keys[i].typ, _ = scalarValue(mappingValue(item, "type"))
+		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].typ != keys[j].typ {
+			return keys[i].typ < keys[j].typ
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	out := make([]*yaml.Node, len(keys))
+	for i, k := range keys {
+		out[i] = k.node
+	}
+	return out
+}
@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSortOrder(t *testing.T) {
+	p := `
+resources:
+- name: zeta
+  type: git
+- name: alpha
+  type: time
+merge:
+- template: test.d/resource_with_type.yaml
+`
+	tests := []struct {
+		order    SortOrder
+		expected []string
+	}{
+		{"", []string{"slack-alert", "zeta", "alpha"}},
+		{SortFirstSeen, []string{"zeta", "alpha", "slack-alert"}},
+		{SortByName, []string{"alpha", "slack-alert", "zeta"}},
+		{SortByTypeThenName, []string{"zeta", "slack-alert", "alpha"}},
+	}
+	for _, test := range tests {
+		merger, err := NewPipeline(p, nil, nil, WithSortOrder(test.order))
+		if err != nil {
+			t.Fatalf("Error creating pipeline: %v", err)
+		}
+		pipeline, err := merger.Transform()
+		if err != nil {
+			t.Fatalf("Error transforming %v: %v", p, err)
+		}
+
+		var names []string
+		for _, r := range pipeline.Resources {
+			name, _ := getName(r)
+			names = append(names, name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Expected resources ordered %v with %q, got %v", test.expected, test.order, names)
+		}
+	}
+}
+
+func TestParseSortOrder(t *testing.T) {
+	if _, err := ParseSortOrder("by-colour"); err == nil {
+		t.Errorf("Expected an unknown sort order to fail")
+	}
+	if o, err := ParseSortOrder("by-name"); err != nil || o != SortByName {
+		t.Errorf("Expected by-name to parse, got %q, %v", o, err)
+	}
+}
+
+func TestTransformIsDeterministic(t *testing.T) {
+	p := `
+merge:
+- template: test.d/job_with_params.yaml
+  args:
+    param1: a
+    param2:
+      nested: [1, 2]
+      other: {z: 1, a: 2}
+    param3: c
+- template: test.d/resource_with_type.yaml
+- template: test.d/group1.yaml
+`
+	var first string
+	for i := 0; i < 10; i++ {
+		merger, err := NewPipeline(p, nil, nil)
+		if err != nil {
+			t.Fatalf("Error creating pipeline: %v", err)
+		}
+		pipeline, err := merger.Transform()
+		if err != nil {
+			t.Fatalf("Error transforming %v: %v", p, err)
+		}
+		out, err := pipeline.Marshal()
+		if err != nil {
+			t.Fatalf("Error marshalling pipeline: %v", err)
+		}
+		if i == 0 {
+			first = out
+		} else if out != first {
+			t.Fatalf("Expected identical output on every run, got:\n%s\nthen:\n%s", first, out)
+		}
+	}
+}
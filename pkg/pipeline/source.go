@@ -0,0 +1,175 @@
+package pipeline
+
+import yaml "go.yaml.in/yaml/v3"
+
+// mergeSource is a node in the tree of `merge:` entries, linked to the entry
+// that merged the template containing it. path is the file the template was
+// resolved to, and is empty for the root pipeline; lookup records how it was
+// found.
+type mergeSource struct {
+	frame  MergeFrame
+	path   string
+	lookup string
+	parent *mergeSource
+}
+
+// depth returns the number of `merge:` entries between s and the root.
+func (s *mergeSource) depth() int {
+	depth := 0
+	for n := s; n != nil && n.parent != nil; n = n.parent {
+		depth++
+	}
+	return depth
+}
+
+// checkCycle fails if the file s resolved to is already being expanded
+// further up the merge chain.
+func (s *mergeSource) checkCycle() error {
+	for n := s.parent; n != nil; n = n.parent {
+		if n.path == "" || n.path != s.path {
+			continue
+		}
+		var templates []string
+		for m := s; m != n.parent; m = m.parent {
+			templates = append([]string{m.frame.Template}, templates...)
+		}
+		return &MergeCycleError{Templates: templates}
+	}
+	return nil
+}
+
+// template returns the template s was rendered from, or "pipeline" for the
+// root pipeline.
+func (s *mergeSource) template() string {
+	if s == nil {
+		return "pipeline"
+	}
+	return s.frame.Template
+}
+
+// chain returns the frames from the root pipeline down to s.
+func (s *mergeSource) chain() []MergeFrame {
+	var frames []MergeFrame
+	for n := s; n != nil; n = n.parent {
+		frames = append([]MergeFrame{n.frame}, frames...)
+	}
+	return frames
+}
+
+// mergeSource returns the source of the i'th merge entry.
+func (p *Pipeline) mergeSource(i int) *mergeSource {
+	if i < len(p.mergeSources) && p.mergeSources[i] != nil {
+		return p.mergeSources[i]
+	}
+	return p.root
+}
+
+// sources returns the merge sources of p aligned with p.Merge.
+func (p *Pipeline) sources() []*mergeSource {
+	out := make([]*mergeSource, len(p.Merge))
+	for i := range out {
+		out[i] = p.mergeSource(i)
+	}
+	return out
+}
+
+// Kinds of named pipeline objects, as used in objectKey and reported by
+// Validate.
+const (
+	kindJob          = "job"
+	kindResource     = "resource"
+	kindResourceType = "resource_type"
+	kindGroup        = "group"
+	kindVarSource    = "var_source"
+	kindDisplay      = "display"
+)
+
+// objectKey identifies a named object within a pipeline.
+type objectKey struct {
+	kind string
+	name string
+}
+
+// origin returns the template which introduced the named object.
+func (p *Pipeline) origin(kind string, name string) *mergeSource {
+	if s, ok := p.origins[objectKey{kind, name}]; ok {
+		return s
+	}
+	return p.root
+}
+
+// mergeOrigins returns p1's origins extended with any object first introduced
+// by the sub-pipeline p2. Objects p2 replaces or merges into under s are
+// attributed to p2. p1's map is updated in place, as the merged pipeline
+// replaces p1, so that each merge costs the size of p2 rather than of the
+// pipeline so far.
+func mergeOrigins(p1 Pipeline, p2 Pipeline, s Strategy) map[objectKey]*mergeSource {
+	out := p1.origins
+	if out == nil {
+		out = map[objectKey]*mergeSource{}
+	}
+	if p2.source == nil {
+		return out
+	}
+
+	replaces := s == StrategyLastWins || s == StrategyDeepMerge || s == StrategyExtend
+	lists := []struct {
+		kind  string
+		items []*yaml.Node
+	}{
+		{kindJob, p2.Jobs},
+		{kindResource, p2.Resources},
+		{kindResourceType, p2.ResourceTypes},
+		{kindGroup, p2.Groups},
+		{kindVarSource, p2.VarSources},
+	}
+	for _, l := range lists {
+		for _, item := range l.items {
+			name, err := getName(item)
+			if err != nil {
+				continue
+			}
+			key := objectKey{l.kind, name}
+			if _, ok := out[key]; (replaces && l.kind != kindGroup) || (!ok && !p1.has(l.kind, name)) {
+				out[key] = p2.source
+			}
+		}
+	}
+
+	key := objectKey{kindDisplay, ""}
+	if _, ok := out[key]; !isNull(p2.Display) && (replaces || (!ok && !p1.has(kindDisplay, ""))) {
+		out[key] = p2.source
+	}
+	return out
+}
+
+// copyOrigins returns a copy of origins, for a pipeline which will be merged
+// into.
+func copyOrigins(origins map[objectKey]*mergeSource) map[objectKey]*mergeSource {
+	out := make(map[objectKey]*mergeSource, len(origins))
+	for k, v := range origins {
+		out[k] = v
+	}
+	return out
+}
+
+// has reports whether p already contains the named object.
+func (p *Pipeline) has(kind string, name string) bool {
+	var items []*yaml.Node
+	switch kind {
+	case kindJob:
+		items = p.Jobs
+	case kindResource:
+		items = p.Resources
+	case kindResourceType:
+		items = p.ResourceTypes
+	case kindGroup:
+		items = p.Groups
+	case kindVarSource:
+		items = p.VarSources
+	case kindDisplay:
+		return !isNull(p.Display)
+	}
+	_, exists, _ := findValue(name, items)
+	return exists
+}
@@ -0,0 +1,169 @@
+package pipeline
+
+import (
+	"fmt"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// Strategy selects how a `merge:` entry's resources, resource types and jobs
+// are combined with objects of the same name already in the pipeline.
+type Strategy string
+
+// Merge strategies. StrategyError accepts a repeated object only if it is
+// identical to the existing one. StrategyFirstWins keeps the existing object
+// and StrategyLastWins replaces it. StrategyDeepMerge recursively merges the
+// incoming object's maps into the existing one, replacing lists and scalars.
+// StrategyExtend does the same but appends to lists, e.g. to add steps to the
+// plan of a job defined elsewhere.
+const (
+	StrategyError     Strategy = "error"
+	StrategyFirstWins Strategy = "first-wins"
+	StrategyLastWins  Strategy = "last-wins"
+	StrategyDeepMerge Strategy = "deep-merge"
+	StrategyExtend    Strategy = "extend"
+)
+
+// ParseStrategy validates a merge strategy name.
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case StrategyError, StrategyFirstWins, StrategyLastWins, StrategyDeepMerge, StrategyExtend:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown merge strategy %q, expected %q, %q, %q, %q or %q",
+		name, StrategyError, StrategyFirstWins, StrategyLastWins, StrategyDeepMerge, StrategyExtend)
+}
+
+// mergeNamed combines the named objects already in a pipeline with those of
+// an incoming sub-pipeline. The objects of incoming are laid out first when
+// incomingFirst is set. Objects sharing a name are resolved with s, in the
+// position of the first of them. Without a strategy, or with StrategyError,
+// identical objects are collapsed and conflict names the first which differ.
+// Each list is expected to have been through dedupe, so that a conflict is
+// always between an existing object and an incoming one.
+func mergeNamed(existing []*yaml.Node, incoming []*yaml.Node, s Strategy, incomingFirst bool) (out []*yaml.Node, conflict string, err error) {
+	first, second := existing, incoming
+	if incomingFirst {
+		first, second = incoming, existing
+	}
+
+	out = make([]*yaml.Node, 0, len(first)+len(second))
+	out = append(out, first...)
+
+	for _, v := range second {
+		name, err := getName(v)
+		if err != nil {
+			return nil, "", err
+		}
+		index, err := findIndex(name, out)
+		if err != nil {
+			return nil, "", err
+		}
+		if index < 0 {
+			out = append(out, v)
+			continue
+		}
+
+		e, i := out[index], v
+		if incomingFirst {
+			e, i = v, out[index]
+		}
+		resolved, ok := resolveNodes(e, i, s)
+		if !ok {
+			return out, name, nil
+		}
+		out[index] = resolved
+	}
+
+	return out, "", nil
+}
+
+// dedupe collapses the identical repeats of a named object within each of
+// p's lists, rendered from the template name, keeping the first. An object
+// defined differently more than once by the template is reported as a
+// DuplicateError, whatever the merge strategy, as there is no earlier or
+// later definition for a strategy to choose between.
+func (p *Pipeline) dedupe(name string) error {
+	lists := []struct {
+		kind  string
+		items *[]*yaml.Node
+	}{
+		{kindVarSource, &p.VarSources},
+		{kindResourceType, &p.ResourceTypes},
+		{kindResource, &p.Resources},
+		{kindJob, &p.Jobs},
+	}
+	for _, l := range lists {
+		out := make([]*yaml.Node, 0, len(*l.items))
+		for _, v := range *l.items {
+			object, err := getName(v)
+			if err != nil {
+				return &YAMLError{Name: name, Err: err}
+			}
+			existing, found, err := findValue(object, out)
+			if err != nil {
+				return &YAMLError{Name: name, Err: err}
+			}
+			if !found {
+				out = append(out, v)
+				continue
+			}
+			if !nodesEqual(existing, v) {
+				return &DuplicateError{Kind: l.kind, Name: object, Templates: []string{name}}
+			}
+		}
+		*l.items = out
+	}
+	return nil
+}
+
+// resolveNodes combines an existing object with an incoming one of the same
+// name, or that appears only once in a pipeline such as `display`, using s.
+// Identical objects are collapsed whatever s is, so that a dependency bundled
+// by several templates is not, say, extended with itself. It returns false if
+// s is StrategyError, or unset, and they differ.
+func resolveNodes(existing *yaml.Node, incoming *yaml.Node, s Strategy) (*yaml.Node, bool) {
+	if isNull(existing) {
+		return incoming, true
+	}
+	if isNull(incoming) || nodesEqual(existing, incoming) {
+		return existing, true
+	}
+
+	switch s {
+	case StrategyFirstWins:
+		return existing, true
+	case StrategyLastWins:
+		return incoming, true
+	case StrategyDeepMerge:
+		return deepMergeNodes(existing, incoming, false), true
+	case StrategyExtend:
+		return deepMergeNodes(existing, incoming, true), true
+	}
+	return existing, false
+}
+
+// deepMergeNodes returns base with override merged into it. Maps are merged
+// key by key, keeping base's key order and appending new keys. Lists are
+// appended to when extend is set; anything else in override replaces the
+// value in base. Only the maps and lists along the merged paths are copied;
+// the values within them are shared with base and override, so that plan
+// steps keep the identity their provenance is recorded against.
+func deepMergeNodes(base *yaml.Node, override *yaml.Node, extend bool) *yaml.Node {
+	if extend && base != nil && base.Kind == yaml.SequenceNode && override != nil && override.Kind == yaml.SequenceNode {
+		out := *base
+		out.Content = append(append([]*yaml.Node{}, base.Content...), override.Content...)
+		return &out
+	}
+	if base == nil || base.Kind != yaml.MappingNode || override == nil || override.Kind != yaml.MappingNode {
+		return override
+	}
+
+	out := *base
+	out.Content = append([]*yaml.Node{}, base.Content...)
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		key := override.Content[i].Value
+		setMappingValue(&out, key, deepMergeNodes(mappingValue(&out, key), override.Content[i+1], extend))
+	}
+	return &out
+}
@@ -0,0 +1 @@
+- put: email-alert
@@ -0,0 +1 @@
+- put: slack-alert
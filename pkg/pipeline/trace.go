@@ -0,0 +1,222 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// How a `merge:` template path was found, as recorded in a TraceEntry.
+// LookupPath means the path was read as written, relative to the working
+// directory, and LookupRelative that it was read relative to the including
+// file or the root pipeline. LookupIndex means it was looked up by name among
+// the templates parsed alongside the pipeline.
+const (
+	LookupPath     = "path"
+	LookupRelative = "relative"
+	LookupIndex    = "index"
+)
+
+// Trace records the `merge:` entries processed by Transform as a tree rooted
+// at the pipeline. Pass one to NewPipeline with WithTrace; it is filled in as
+// the pipeline is transformed, including the entries processed before
+// transformation fails.
+type Trace struct {
+	Root    *TraceEntry
+	entries map[*mergeSource]*TraceEntry
+}
+
+// TraceEntry is the pipeline or one `merge:` entry in a Trace. Template is
+// the path as written, and Path and Lookup record the file it was read from
+// and how that was found. Added counts the objects of each kind the entry
+// introduced; Deduplicated lists those identical to an object already in the
+// pipeline and collapsed into it, and Resolved those combined with an
+// existing object by Strategy. Error is set if the entry failed.
+type TraceEntry struct {
+	Template     string         `json:"template"`
+	Path         string         `json:"path,omitempty"`
+	Lookup       string         `json:"lookup,omitempty"`
+	Args         interface{}    `json:"args,omitempty"`
+	Strategy     Strategy       `json:"strategy,omitempty"`
+	Added        map[string]int `json:"added,omitempty"`
+	Deduplicated []TraceObject  `json:"deduplicated,omitempty"`
+	Resolved     []TraceObject  `json:"resolved,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	Children     []*TraceEntry  `json:"children,omitempty"`
+}
+
+// TraceObject names an object of a pipeline. Name is empty for `display`.
+type TraceObject struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+}
+
+func (o TraceObject) String() string {
+	object := strings.Replace(o.Kind, "_", " ", -1)
+	if o.Name == "" {
+		return object
+	}
+	return fmt.Sprintf("%s %s", object, o.Name)
+}
+
+// WithTrace records the `merge:` entries processed by Transform in t.
+func WithTrace(t *Trace) Option {
+	return func(o *options) {
+		o.trace = t
+	}
+}
+
+// add returns the entry for s, adding it and its ancestors to the tree if
+// they are not there yet. It returns nil if t is nil.
+func (t *Trace) add(s *mergeSource, strategy Strategy) *TraceEntry {
+	if t == nil || s == nil {
+		return nil
+	}
+	if e, ok := t.entries[s]; ok {
+		return e
+	}
+	if t.entries == nil {
+		t.entries = map[*mergeSource]*TraceEntry{}
+	}
+
+	e := &TraceEntry{
+		Template: s.frame.Template,
+		Path:     s.path,
+		Lookup:   s.lookup,
+		Args:     jsonCompatible(s.frame.Args),
+		Strategy: strategy,
+	}
+	t.entries[s] = e
+	if s.parent == nil {
+		t.Root = e
+	} else if parent := t.add(s.parent, ""); parent != nil {
+		parent.Children = append(parent.Children, e)
+	}
+	return e
+}
+
+// fail records that the entry failed with err.
+func (e *TraceEntry) fail(err error) {
+	if e != nil {
+		e.Error = err.Error()
+	}
+}
+
+// contributions records what merging the sub-pipeline incoming into existing
+// adds, collapses and resolves.
+func (e *TraceEntry) contributions(existing Pipeline, incoming Pipeline) {
+	if e == nil {
+		return
+	}
+
+	current := existing.objectLists()
+	for i, l := range incoming.objectLists() {
+		for _, item := range l.items {
+			name, err := getName(item)
+			if err != nil {
+				continue
+			}
+			n, exists, _ := findValue(name, current[i].items)
+			e.contributed(TraceObject{Kind: l.kind, Name: name}, exists, exists && nodesEqual(n, item))
+		}
+	}
+	if !isNull(incoming.Display) {
+		exists := !isNull(existing.Display)
+		e.contributed(TraceObject{Kind: kindDisplay}, exists, exists && nodesEqual(existing.Display, incoming.Display))
+	}
+}
+
+func (e *TraceEntry) contributed(o TraceObject, exists bool, identical bool) {
+	switch {
+	case !exists:
+		if e.Added == nil {
+			e.Added = map[string]int{}
+		}
+		e.Added[o.Kind]++
+	case identical:
+		e.Deduplicated = append(e.Deduplicated, o)
+	default:
+		e.Resolved = append(e.Resolved, o)
+	}
+}
+
+// String renders the trace as an indented tree, one `merge:` entry per item.
+func (t *Trace) String() string {
+	if t == nil || t.Root == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(t.Root.Template + "\n")
+	for _, c := range t.Root.Children {
+		c.write(&b, "")
+	}
+	return b.String()
+}
+
+func (e *TraceEntry) write(b *strings.Builder, indent string) {
+	fmt.Fprintf(b, "%s- %s\n", indent, e.describe())
+	indent += "  "
+
+	if e.Args != nil {
+		if data, err := json.Marshal(e.Args); err == nil {
+			fmt.Fprintf(b, "%sargs: %s\n", indent, data)
+		}
+	}
+	if e.Strategy != "" {
+		fmt.Fprintf(b, "%sstrategy: %s\n", indent, e.Strategy)
+	}
+	if added := e.added(); added != "" {
+		fmt.Fprintf(b, "%sadded: %s\n", indent, added)
+	}
+	if len(e.Deduplicated) > 0 {
+		fmt.Fprintf(b, "%sdeduplicated: %s\n", indent, joinObjects(e.Deduplicated))
+	}
+	if len(e.Resolved) > 0 {
+		fmt.Fprintf(b, "%sresolved: %s\n", indent, joinObjects(e.Resolved))
+	}
+	if e.Error != "" {
+		fmt.Fprintf(b, "%serror: %s\n", indent, e.Error)
+	}
+	for _, c := range e.Children {
+		c.write(b, indent)
+	}
+}
+
+// describe returns the template as written and how it was found.
+func (e *TraceEntry) describe() string {
+	switch e.Lookup {
+	case LookupPath:
+		return fmt.Sprintf("%s: read as written", e.Template)
+	case LookupRelative:
+		return fmt.Sprintf("%s: read from %s", e.Template, e.Path)
+	case LookupIndex:
+		return fmt.Sprintf("%s: found in the template index as %s", e.Template, e.Path)
+	}
+	return e.Template
+}
+
+// added lists the counts in Added in pipeline order, e.g. "1 job, 2
+// resources".
+func (e *TraceEntry) added() string {
+	var counts []string
+	for _, kind := range []string{kindGroup, kindVarSource, kindResource, kindResourceType, kindJob, kindDisplay} {
+		n := e.Added[kind]
+		if n == 0 {
+			continue
+		}
+		noun := strings.Replace(kind, "_", " ", -1)
+		if n > 1 {
+			noun += "s"
+		}
+		counts = append(counts, fmt.Sprintf("%d %s", n, noun))
+	}
+	return strings.Join(counts, ", ")
+}
+
+func joinObjects(objects []TraceObject) string {
+	names := make([]string, len(objects))
+	for i, o := range objects {
+		names[i] = o.String()
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	p := `
+merge:
+- template: test.d/sub_template.yaml
+- template: test.d/resource_simple.yaml
+  args:
+    param1: github
+- template: test.d/resource_simple.yaml
+  args:
+    param1: github
+`
+	trace := &Trace{}
+	merger, err := NewPipeline(p, nil, nil, WithTrace(trace))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	if _, err := merger.Transform(); err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	expected := `pipeline
+- test.d/sub_template.yaml: read as written
+  - test.d/job_simple.yaml: read as written
+    added: 1 job
+- test.d/resource_simple.yaml: read as written
+  args: {"param1":"github"}
+  added: 1 resource
+- test.d/resource_simple.yaml: read as written
+  args: {"param1":"github"}
+  deduplicated: resource test
+`
+	if got := trace.String(); got != expected {
+		t.Errorf("Expected trace:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestTraceError(t *testing.T) {
+	p := `
+merge:
+- template: test.d/merge_bad_template.yaml
+  args:
+    flag: true
+`
+	trace := &Trace{}
+	merger, err := NewPipeline(p, nil, nil, WithTrace(trace))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	if _, err := merger.Transform(); err == nil {
+		t.Fatalf("Expected transforming %v to fail", p)
+	}
+
+	if len(trace.Root.Children) != 1 || len(trace.Root.Children[0].Children) != 1 {
+		t.Fatalf("Expected the trace to reach the failing template, got:\n%s", trace)
+	}
+	failed := trace.Root.Children[0].Children[0]
+	if failed.Template != "test.d/bad_template.yaml" || failed.Error == "" {
+		t.Errorf("Expected the failing template to be recorded with its error, got %+v", failed)
+	}
+}
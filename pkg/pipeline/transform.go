@@ -2,216 +2,394 @@ package pipeline
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io/fs"
 	"path/filepath"
 	"strings"
 	"text/template"
 
 	"github.com/Masterminds/sprig"
-	"github.com/finbourne/uav/pkg/log"
-	yaml "gopkg.in/yaml.v2"
+	yaml "go.yaml.in/yaml/v3"
+	yamlv2 "gopkg.in/yaml.v2"
 )
 
 // Pipeline is the piepline definition.  Added `merge` directive.
 type Pipeline struct {
-	Merge          []interface{} `yaml:"merge,omitempty"`
-	Groups         []interface{} `yaml:"groups,omitempty"`
-	Resources      []interface{} `yaml:"resources,omitempty"`
-	ResourceTypes  []interface{} `yaml:"resource_types,omitempty"`
-	Jobs           []interface{} `yaml:"jobs,omitempty"`
-	extraTemplates []string
-	templateIndex  map[string]string
+	Merge         []*yaml.Node `yaml:"merge,omitempty"`
+	Groups        []*yaml.Node `yaml:"groups,omitempty"`
+	VarSources    []*yaml.Node `yaml:"var_sources,omitempty"`
+	Resources     []*yaml.Node `yaml:"resources,omitempty"`
+	ResourceTypes []*yaml.Node `yaml:"resource_types,omitempty"`
+	Jobs          []*yaml.Node `yaml:"jobs,omitempty"`
+	Display       *yaml.Node   `yaml:"display,omitempty"`
+	templateIndex *templateIndex
+	// mergeSources records, for each entry in Merge, the template that
+	// contributed it. A nil entry means the root pipeline.
+	mergeSources []*mergeSource
+	root         *mergeSource
+	opts         *options
+	// source is the template a sub-pipeline was rendered from, and origins
+	// the template that introduced each named object. Objects without an
+	// origin came from the root pipeline.
+	source  *mergeSource
+	origins map[objectKey]*mergeSource
+	// generated records how each group generateGroups created from rules or
+	// as the all group was generated, rather than read from a template.
+	generated map[string]string
+	// stepOrigins records the template that introduced each plan step of a
+	// job, where that is not the root pipeline.
+	stepOrigins map[*yaml.Node]*mergeSource
+	// unknownKeys are the top-level keys UAV does not understand, and
+	// warnings the problems found with them so far.
+	unknownKeys []*yaml.Node
+	warnings    []string
+	// keys are the top-level key nodes the pipeline was read with, and
+	// headComment and footComment the comments of its document, so that
+	// comments on them are written back out.
+	keys        map[string]*yaml.Node
+	headComment string
+	footComment string
 }
 
 type mergeConfig struct {
 	FilePath   string      `yaml:"template"`
 	Parameters interface{} `yaml:"args,omitempty"`
+	Strategy   Strategy    `yaml:"strategy,omitempty"`
 }
 
 func (mc *mergeConfig) String() string {
 	return fmt.Sprintf("Template path: %s, parameters: %v", mc.FilePath, mc.Parameters)
 }
 
+// settings holds UAV's own per-pipeline options, read from the root
+// pipeline's top-level `uav` key. They are never written to the output.
+type settings struct {
+	Resolve string        `yaml:"resolve,omitempty"`
+	Groups  groupSettings `yaml:"groups,omitempty"`
+}
+
 // NewPipeline constructs a merger object for merging pipelines.
-func NewPipeline(pipeline string, args map[string]interface{}, templates []string) (*Pipeline, error) {
-	out := transformTemplateWithParams(args, pipeline, templates)
+func NewPipeline(pipeline string, args map[string]interface{}, templates []string, opts ...Option) (*Pipeline, error) {
+	return NewPipelineContext(context.Background(), pipeline, args, templates, opts...)
+}
+
+// NewPipelineContext is NewPipeline, abandoning rendering the pipeline
+// template with an error if ctx is done first. As with TransformContext, a
+// loop which cannot be interrupted runs on in the background.
+func NewPipelineContext(ctx context.Context, pipeline string, args map[string]interface{}, templates []string, opts ...Option) (*Pipeline, error) {
+	o := newOptions(opts)
+	root := &mergeSource{frame: MergeFrame{Template: "pipeline"}}
+	if len(args) > 0 {
+		root.frame.Args = args
+	}
+	if o.pipelineFile != "" {
+		root.frame.Template = o.pipelineFile
+		root.path = filepath.Clean(o.pipelineFile)
+	}
+	index := buildTemplateIndex(templates, o.templateRoots, o.fileSystem())
+
+	out, err := transformTemplateWithParams(ctx, root.frame.Template, args, pipeline, index, o)
+	if err != nil {
+		return nil, newPipelineError(err, root, index)
+	}
 
 	var p Pipeline
-	err := yaml.Unmarshal([]byte(out), &p)
+	err = unmarshalPipeline([]byte(out), &p)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshalling pipeline: %v: %v", out, err)
+		return nil, newPipelineError(&YAMLError{Name: root.frame.Template, Err: err}, root, index)
 	}
 
-	p.extraTemplates = templates
-	p.templateIndex = buildTemplateIndex(templates)
-	return &p, nil
-}
+	var doc struct {
+		Settings settings `yaml:"uav"`
+	}
+	if err := yaml.Unmarshal([]byte(out), &doc); err != nil {
+		return nil, newPipelineError(&YAMLError{Name: root.frame.Template, Err: err}, root, index)
+	}
+	if o.resolution == "" {
+		o.resolution = ResolveWorkingDir
+		if doc.Settings.Resolve != "" {
+			o.resolution, err = ParseResolution(doc.Settings.Resolve)
+			if err != nil {
+				return nil, newPipelineError(&YAMLError{Name: root.frame.Template, Err: err}, root, index)
+			}
+		}
+	}
 
-// buildTemplateIndex keys each template file by its basename, matching the
-// naming scheme text/template's ParseFiles uses for associated templates. This
-// lets `merge:` lookups fall back to the same set that `{{ template }}` and
-// `{{ include }}` resolve against.
-func buildTemplateIndex(templates []string) map[string]string {
-	index := make(map[string]string, len(templates))
-	for _, f := range templates {
-		index[filepath.Base(f)] = f
+	rules, err := doc.Settings.Groups.rules()
+	if err != nil {
+		return nil, newPipelineError(&YAMLError{Name: root.frame.Template, Err: err}, root, index)
 	}
-	return index
+	o.groupRules = append(rules, o.groupRules...)
+	if o.allGroup == "" {
+		o.allGroup = doc.Settings.Groups.All
+	}
+
+	if err := p.checkKeys(root.frame.Template, o); err != nil {
+		return nil, newPipelineError(err, root, index)
+	}
+	if err := p.dedupe(root.frame.Template); err != nil {
+		return nil, newPipelineError(err, root, index)
+	}
+
+	p.templateIndex = index
+	p.root = root
+	p.opts = o
+	return &p, nil
 }
 
 // Transform takes the current pipeline and begins recursive transformation to produce the finished pipeline.
 func (p *Pipeline) Transform() (*Pipeline, error) {
-	var err error
+	return p.TransformContext(context.Background())
+}
+
+// TransformContext is Transform, stopping with an error identifying the
+// template being rendered if ctx is done first. A template looping without
+// writing output or calling `include`, `until`, `untilStep` or a
+// function set with WithFuncs cannot be interrupted: the error is still
+// returned, but the loop runs on in the background until it finishes.
+func (p *Pipeline) TransformContext(ctx context.Context) (*Pipeline, error) {
 	pipeline := Pipeline{
-		Groups:         p.Groups,
-		Resources:      p.Resources,
-		ResourceTypes:  p.ResourceTypes,
-		Jobs:           p.Jobs,
-		extraTemplates: p.extraTemplates,
-		templateIndex:  p.templateIndex,
+		Groups:        p.Groups,
+		VarSources:    p.VarSources,
+		Resources:     p.Resources,
+		ResourceTypes: p.ResourceTypes,
+		Jobs:          p.Jobs,
+		Display:       p.Display,
+		templateIndex: p.templateIndex,
+		root:          p.root,
+		opts:          p.opts,
+		origins:       copyOrigins(p.origins),
+		stepOrigins:   copyStepOrigins(p.stepOrigins),
+		warnings:      p.warnings,
+		keys:          p.keys,
+		headComment:   p.headComment,
+		footComment:   p.footComment,
 	}
 
-	log.Infof("Merging %d merge clauses...", len(p.Merge))
+	p.opts.tracer().add(p.root, "")
+	p.opts.logger().Infof("Merging %d merge clauses...", len(p.Merge))
 	if len(p.Merge) > 0 {
-		for _, v := range p.Merge {
-			c := mapInterfaceInterfaceToMapStringInterface(v.(map[interface{}]interface{}))
-			if mc, ok := mergeConfigFromTemplateWithParams(c); ok {
-				log.Infof("Merging: %v", &mc)
-				cp := mapInterfaceInterfaceToPipeline(stringToMapInterfaceInterface(transformTemplateWithParams(mc.Parameters, getYamlMap(mc.FilePath, pipeline.templateIndex), pipeline.extraTemplates)))
-				pipelineBeforeMerge := pipeline
-				pipeline, err = merge(pipeline, cp)
-				if err != nil {
-					return nil, fmt.Errorf("unable to merge pipeline %v: %v", pipelineBeforeMerge, err)
-				}
+		entries := p.mergeEntries()
+		p.renderMergeEntries(ctx, entries)
+		for _, e := range entries {
+			if e.err != nil {
+				return nil, newPipelineError(&YAMLError{Name: "merge", Err: e.err}, e.source, p.templateIndex)
 			}
-		}
 
-		newPipeline, err := pipeline.Transform()
-		if err != nil {
-			return nil, fmt.Errorf("unable to transform pipeline %v: %v", pipeline, err)
+			mc, frame := e.mc, e.frame
+			p.opts.logger().Infof("Merging: %v", &mc)
+			if frame.path != "" && p.opts != nil && p.opts.onRead != nil {
+				p.opts.onRead(frame.path)
+			}
+			entry := p.opts.tracer().add(frame, mc.Strategy)
+			if e.renderErr != nil {
+				entry.fail(e.renderErr)
+				return nil, newPipelineError(e.renderErr, frame, pipeline.templateIndex)
+			}
+			cp := e.out
+			entry.contributions(pipeline, cp)
+			cp.source = frame
+			cp.mergeSources = make([]*mergeSource, len(cp.Merge))
+			for j := range cp.mergeSources {
+				cp.mergeSources[j] = frame
+			}
+			var err error
+			pipeline, err = mergeWithStrategy(pipeline, cp, mc.Strategy)
+			if err != nil {
+				entry.fail(err)
+				return nil, newPipelineError(&MergeError{Name: mc.FilePath, Err: err}, frame, pipeline.templateIndex)
+			}
 		}
 
-		return newPipeline, nil
+		return pipeline.TransformContext(ctx)
 	}
 
+	if err := pipeline.generateGroups(); err != nil {
+		return nil, err
+	}
+	pipeline.sortObjects(p.opts.sortOrder())
 	return &pipeline, nil
 }
 
-func (p *Pipeline) String() string {
-	text, err := yaml.Marshal(&p)
+// renderMergeConfig reads, renders and parses the template referenced by a
+// single `merge:` entry, recording the file it resolved to in frame. It may be
+// called concurrently for the entries of one level.
+func (p *Pipeline) renderMergeConfig(ctx context.Context, mc mergeConfig, frame *mergeSource) (Pipeline, error) {
+	source, path, lookup, err := getYamlMap(p.opts.fileSystem(), mc.FilePath, p.searchDirs(frame.parent), p.templateIndex)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		return Pipeline{}, &TemplateError{Name: mc.FilePath, Err: err}
 	}
 
-	return string(text)
-}
+	frame.path = path
+	frame.lookup = lookup
+	if err := frame.checkCycle(); err != nil {
+		return Pipeline{}, err
+	}
+	if p.opts != nil && p.opts.maxDepth > 0 && frame.depth() > p.opts.maxDepth {
+		return Pipeline{}, fmt.Errorf("%w: %d", ErrMaxMergeDepth, p.opts.maxDepth)
+	}
 
-func mergeConfigFromTemplateWithParams(data map[string]interface{}) (mergeConfig, bool) {
-	if data["template"] == nil {
-		return mergeConfig{}, false
+	// The same template merged with the same arguments renders the same
+	// text, so it is rendered once; each use still parses it afresh, keeping
+	// the provenance of its nodes separate.
+	key, memoisable := newRenderKey(path, mc.Parameters)
+	out, ok := "", false
+	if memoisable {
+		out, ok = p.templateIndex.output(key)
+	}
+	if !ok {
+		out, err = transformTemplateWithParams(ctx, mc.FilePath, mc.Parameters, source, p.templateIndex, p.opts)
+		if err != nil {
+			return Pipeline{}, err
+		}
+		if memoisable {
+			p.templateIndex.memoise(key, out)
+		}
 	}
 
-	var m mergeConfig
-	m.FilePath = data["template"].(string)
-	if data["args"] != nil {
-		m.Parameters = data["args"]
+	var cp Pipeline
+	if err := unmarshalPipeline([]byte(out), &cp); err != nil {
+		return Pipeline{}, &YAMLError{Name: mc.FilePath, Err: err}
+	}
+	if err := cp.checkKeys(mc.FilePath, p.opts); err != nil {
+		return Pipeline{}, err
+	}
+	if err := cp.dedupe(mc.FilePath); err != nil {
+		return Pipeline{}, err
 	}
 
-	return m, true
+	return cp, nil
 }
 
-func mapInterfaceInterfaceToPipeline(data map[interface{}]interface{}) Pipeline {
-	m := mapInterfaceInterfaceToMapStringInterface(data)
-	pipeline := Pipeline{}
-	if m["groups"] != nil {
-		pipeline.Groups = m["groups"].([]interface{})
-	}
-	if m["jobs"] != nil {
-		pipeline.Jobs = m["jobs"].([]interface{})
+// Warnings returns the problems found while transforming the pipeline which
+// did not prevent it, such as top-level keys UAV does not understand.
+func (p *Pipeline) Warnings() []string {
+	return p.warnings
+}
+
+// Marshal renders the pipeline as YAML.
+func (p *Pipeline) Marshal() (string, error) {
+	return marshalYaml(p.document())
+}
+
+// String renders the pipeline as YAML. Marshalling errors are logged and an
+// empty string returned; use Marshal to handle them.
+func (p *Pipeline) String() string {
+	text, err := p.Marshal()
+	if err != nil {
+		p.opts.logger().Errorf("error: %v", err)
 	}
-	if m["merge"] != nil {
-		pipeline.Merge = m["merge"].([]interface{})
+
+	return text
+}
+
+func mergeConfigFromTemplateWithParams(data *yaml.Node) (mergeConfig, bool, error) {
+	if data.Kind != yaml.MappingNode {
+		return mergeConfig{}, false, fmt.Errorf("line %d: merge entry should be a map", data.Line)
 	}
-	if m["resource_types"] != nil {
-		pipeline.ResourceTypes = m["resource_types"].([]interface{})
+
+	template := mappingValue(data, "template")
+	if isNull(template) {
+		return mergeConfig{}, false, nil
 	}
-	if m["resources"] != nil {
-		pipeline.Resources = m["resources"].([]interface{})
+
+	var m mergeConfig
+	path, ok := scalarValue(template)
+	if !ok {
+		return mergeConfig{}, false, fmt.Errorf("line %d: merge template should be a string", template.Line)
 	}
-	return pipeline
-}
+	m.FilePath = path
 
-func mapInterfaceInterfaceToMapStringInterface(data map[interface{}]interface{}) map[string]interface{} {
-	m := make(map[string]interface{})
+	params, err := decodeNode(mappingValue(data, "args"))
+	if err != nil {
+		return mergeConfig{}, false, err
+	}
+	m.Parameters = params
 
-	for key, value := range data {
-		switch key := key.(type) {
-		case string:
-			m[key] = value
-		default:
-			log.Fatal("key should be string")
+	if strategy := mappingValue(data, "strategy"); !isNull(strategy) {
+		name, _ := scalarValue(strategy)
+		m.Strategy, err = ParseStrategy(name)
+		if err != nil {
+			return mergeConfig{}, false, fmt.Errorf("line %d: %v", strategy.Line, err)
 		}
 	}
-	return m
+
+	return m, true, nil
 }
 
-// getYamlMap resolves a `merge:` template reference. It first reads the path
-// literally (preserving the existing CWD-relative behaviour), then falls back
-// to looking the basename up in index — the same lookup scheme text/template
-// uses for `{{ template }}` and `{{ include }}`.
-func getYamlMap(filename string, index map[string]string) string {
-	if data, err := os.ReadFile(filename); err == nil {
-		return string(data)
-	} else if !os.IsNotExist(err) {
-		log.Fatalf("Template unable to be read: %s: %v", filename, err)
+// searchDirs returns the directories a `merge:` entry contributed by parent
+// is resolved against, in order. An empty directory means the path is read
+// as written, i.e. relative to the working directory.
+func (p *Pipeline) searchDirs(parent *mergeSource) []string {
+	if p.opts == nil || p.opts.resolution != ResolveRelative {
+		return []string{""}
 	}
 
-	if resolved, ok := index[filepath.Base(filename)]; ok {
-		if data, err := os.ReadFile(resolved); err == nil {
-			return string(data)
+	dirs := []string{p.opts.rootDir()}
+	if parent != nil && parent.path != "" {
+		if dir := filepath.Dir(parent.path); dir != dirs[0] {
+			dirs = append([]string{dir}, dirs...)
 		}
 	}
-
-	log.Fatalf("Template unable to be read: %s", filename)
-	return ""
+	return dirs
 }
 
-func transformTemplateWithParams(params interface{}, t string, ts []string) string {
-	templates := template.New("pipeline")
-	var err error
-	if len(ts) > 0 {
-		templates, err = templates.Funcs(funcMap(templates)).ParseFiles(ts...)
-		if err != nil {
-			log.Fatalf("%v\n\nTemplate: %v", err, t)
+// getYamlMap resolves a `merge:` template reference, returning its content,
+// the path it was read from and how that was found. It first reads the path
+// from fsys relative to each of dirs in turn (an empty dir preserving the
+// existing CWD-relative behaviour), then falls back to looking the name up in
+// index — the same names `{{ template }}` and `{{ include }}` resolve against.
+func getYamlMap(fsys fs.FS, filename string, dirs []string, index *templateIndex) (string, string, string, error) {
+	for _, dir := range dirs {
+		path, lookup := filename, LookupPath
+		if dir != "" && !filepath.IsAbs(filename) {
+			path, lookup = filepath.Join(dir, filename), LookupRelative
+		}
+		if data, err := index.read(fsys, path); err == nil {
+			return string(data), filepath.Clean(path), lookup, nil
+		} else if !isNotFound(err) {
+			return "", "", "", err
 		}
-	} else {
-		templates = templates.Funcs(funcMap(templates))
 	}
-	_, err = templates.Parse(t)
+
+	resolved, err := index.lookup(filename)
 	if err != nil {
-		log.Fatalf("%v\n\nTemplate: %v", err, t)
+		return "", "", "", err
 	}
-
-	buf := bytes.NewBufferString("")
-	err = templates.Execute(buf, params)
+	data, err := index.read(fsys, resolved)
 	if err != nil {
-		log.Fatalf("%v\n\nTemplate: %v", err, t)
+		return "", "", "", err
 	}
-
-	return buf.String()
+	return string(data), filepath.Clean(resolved), LookupIndex, nil
 }
 
-func stringToMapInterfaceInterface(data string) map[interface{}]interface{} {
-	buf := bytes.NewBufferString(data)
-	var snippet map[interface{}]interface{}
-	err := yaml.Unmarshal(buf.Bytes(), &snippet)
+// transformTemplateWithParams renders the template text t, named name in any
+// error returned, with params as its data. The templates in index are parsed
+// alongside it so they can be used by `{{ template }}` and `{{ include }}`;
+// they are parsed once per index and cloned for each call. Any environment
+// allow-list in o is applied.
+func transformTemplateWithParams(ctx context.Context, name string, params interface{}, t string, index *templateIndex, o *options) (string, error) {
+	templates, err := index.templates(ctx, o)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v\n%v", err, data)
+		return "", &TemplateError{Name: name, Err: err}
+	}
+	_, err = templates.Parse(t)
+	if err != nil {
+		return "", &TemplateError{Name: name, Err: err}
 	}
-	return snippet
 
+	buf := bytes.NewBufferString("")
+	err = execute(ctx, templates, buf, withEnv(params, o.envPolicy()))
+	if err != nil {
+		if e := o.envPolicy(); e != nil {
+			err = e.explain(err)
+		}
+		return "", &TemplateError{Name: name, Err: err}
+	}
+
+	return buf.String(), nil
 }
 
 // ToYaml takes an interface, marshals it to yaml, and returns a string. It will
@@ -219,7 +397,7 @@ func stringToMapInterfaceInterface(data string) map[interface{}]interface{} {
 //
 // This is designed to be called from a template.
 func toYaml(v interface{}) string {
-	data, err := yaml.Marshal(v)
+	data, err := yamlv2.Marshal(v)
 	if err != nil {
 		// Swallow errors inside of a template.
 		return ""
@@ -232,7 +410,7 @@ func indentSub(spaces int, v string) string {
 	return strings.Replace(v, "\n", "\n"+pad, -1)
 }
 
-func funcMap(t *template.Template) template.FuncMap {
+func funcMap(ctx context.Context, t *template.Template, index *templateIndex, o *options) template.FuncMap {
 	f := sprig.TxtFuncMap()
 
 	// Add some extra functionality
@@ -242,29 +420,53 @@ func funcMap(t *template.Template) template.FuncMap {
 		"fromYaml":  fromYaml,
 		"toJson":    toJson,
 		"fromJson":  fromJson,
-		"exists":    exists(t),
-		"include":   include(t),
+		"exists":    exists(t, index),
+		"include":   include(ctx, t),
 		"skipLines": skipLines,
+
+		"ambiguousTemplate": ambiguousTemplate(index),
 	}
 
 	for k, v := range extra {
 		f[k] = v
 	}
 
+	// The functions a runaway loop is likely to call fail once ctx is done,
+	// as execute cannot otherwise stop it.
+	for _, k := range []string{"until", "untilStep"} {
+		f[k] = stoppable(ctx, f[k])
+	}
+	for k, v := range o.customFuncs() {
+		f[k] = stoppable(ctx, v)
+	}
+
+	if e := o.envPolicy(); e != nil {
+		f["env"] = e.env
+		f["expandenv"] = e.expandenv
+	}
+
 	return f
 }
 
 // exists and include are factories: they close over the current template set
 // so the returned function can look up associated templates by name at
-// render time.
-func exists(t *template.Template) func(string) bool {
-	return func(name string) bool {
-		return t.Lookup(name) != nil
+// render time. include also closes over the context of the render, so that
+// an included template gives up once it is done, as the including one does.
+func exists(t *template.Template, index *templateIndex) func(string) (bool, error) {
+	return func(name string) (bool, error) {
+		if candidates := index.ambiguous(name); candidates != nil {
+			return false, &AmbiguousTemplateError{Name: name, Candidates: candidates}
+		}
+		return t.Lookup(name) != nil, nil
 	}
 }
 
-func include(t *template.Template) func(string, ...interface{}) (string, error) {
+func include(ctx context.Context, t *template.Template) func(string, ...interface{}) (string, error) {
 	return func(name string, data ...interface{}) (string, error) {
+		if err := ctx.Err(); err != nil {
+			return "", stopped(err)
+		}
+
 		var templateData interface{}
 
 		if len(data) == 1 {
@@ -275,7 +477,7 @@ func include(t *template.Template) func(string, ...interface{}) (string, error)
 		}
 
 		buf := bytes.NewBuffer(nil)
-		if err := t.ExecuteTemplate(buf, name, templateData); err != nil {
+		if err := t.ExecuteTemplate(&contextWriter{ctx: ctx, w: buf}, name, templateData); err != nil {
 			return "", err
 		}
 		return buf.String(), nil
@@ -289,7 +491,7 @@ func skipLines(numberOfLines int, str string) string {
 func fromYaml(str string) map[string]interface{} {
 	m := map[string]interface{}{}
 
-	if err := yaml.Unmarshal([]byte(str), &m); err != nil {
+	if err := yamlv2.Unmarshal([]byte(str), &m); err != nil {
 		m["Error"] = err.Error()
 	}
 	return m
@@ -1,9 +1,13 @@
 package pipeline
 
 import (
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"testing/fstest"
 
-	yaml "gopkg.in/yaml.v2"
+	yaml "go.yaml.in/yaml/v3"
 )
 
 func TestTransformSimpleJob(t *testing.T) {
@@ -35,7 +39,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -45,8 +49,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -103,7 +107,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -113,8 +117,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -163,7 +167,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -174,8 +178,8 @@ jobs:
 
 	result := pipeline.String()
 
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -212,7 +216,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -223,8 +227,8 @@ jobs:
 
 	result := pipeline.String()
 
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -277,7 +281,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -287,8 +291,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -335,7 +339,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -345,8 +349,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -379,7 +383,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -389,8 +393,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -406,15 +410,17 @@ jobs:
   plan:
   - aggregate:
     - get: thing
-  - config:
+  - task: Do Something
+    config:
+      platform: linux
       image_resource:
+        type: docker-image
         source:
           repository: alpine
-        type: docker-image
       inputs:
       - name: thing
-      platform: linux
       run:
+        path: /bin/bash
         args:
         - -cel
         - |
@@ -422,13 +428,11 @@ jobs:
           postgresql:
             postgresPassword: ${password}
           EOF
-        path: /bin/bash
-    task: Do Something
 `
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -438,8 +442,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -461,15 +465,17 @@ jobs:
       trigger: true
       passed:
       - deploy-all
-  - config:
+  - task: Do Something
+    config:
+      platform: linux
       image_resource:
+        type: docker-image
         source:
           repository: alpine
-        type: docker-image
       inputs:
       - name: thing
-      platform: linux
       run:
+        path: /bin/bash
         args:
         - -cel
         - |
@@ -477,13 +483,11 @@ jobs:
           postgresql:
             postgresPassword: ${password}
           EOF
-        path: /bin/bash
-    task: Do Something
 `
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, []string{"test.d/t1.tpl"})
 
 	var err error
@@ -493,8 +497,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -515,7 +519,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, nil)
 
 	var err error
@@ -525,8 +529,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -548,7 +552,7 @@ jobs:
 	pipeline := new(Pipeline)
 
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 	merger, _ := NewPipeline(p, args, []string{"test.d/t2.tpl"})
 
 	var err error
@@ -558,8 +562,8 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
 	}
 }
 
@@ -579,7 +583,7 @@ jobs:
 `
 	pipeline := new(Pipeline)
 	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
-	expected, _ := yaml.Marshal(pipeline)
+	expected := pipeline.String()
 
 	merger, _ := NewPipeline(p, map[string]interface{}{}, nil)
 
@@ -590,7 +594,611 @@ jobs:
 	}
 
 	result := pipeline.String()
-	if result != string(expected) {
-		t.Errorf("[%v] is not equal to [%v]\n", result, string(expected))
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+}
+
+func TestTransformReturnsTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline string
+		check    func(error) bool
+	}{
+		{
+			name:     "parse error in root pipeline",
+			pipeline: "jobs: {{ .unclosed",
+			check: func(err error) bool {
+				var te *TemplateError
+				return errors.As(err, &te) && te.Name == "pipeline"
+			},
+		},
+		{
+			name: "missing merge template",
+			pipeline: `
+merge:
+- template: test.d/does_not_exist.yaml
+`,
+			check: func(err error) bool { return errors.Is(err, ErrTemplateNotFound) },
+		},
+		{
+			name: "merge entry is not a map",
+			pipeline: `
+merge:
+- test.d/job_simple.yaml
+`,
+			check: func(err error) bool {
+				var ye *YAMLError
+				return errors.As(err, &ye)
+			},
+		},
+		{
+			name: "unknown merge strategy",
+			pipeline: `
+merge:
+- template: test.d/job_simple.yaml
+  strategy: newest-wins
+`,
+			check: func(err error) bool {
+				var ye *YAMLError
+				return errors.As(err, &ye) && strings.Contains(err.Error(), "unknown merge strategy")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		merger, err := NewPipeline(test.pipeline, nil, nil)
+		if err == nil {
+			_, err = merger.Transform()
+		}
+		if err == nil || !test.check(err) {
+			t.Errorf("%s: unexpected error %#v", test.name, err)
+		}
+	}
+}
+
+func TestTransformPipelineErrorLocation(t *testing.T) {
+	p := `
+merge:
+- template: test.d/merge_bad_template.yaml
+  args:
+    flag: true
+`
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	_, err = merger.Transform()
+	var pe *PipelineError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Expected a PipelineError, got %#v", err)
+	}
+
+	if pe.File != "test.d/bad_template.yaml" || pe.Line != 3 || pe.Column == 0 {
+		t.Errorf("Unexpected location %s:%d:%d", pe.File, pe.Line, pe.Column)
+	}
+
+	var templates []string
+	for _, f := range pe.Chain {
+		templates = append(templates, f.Template)
+	}
+	expected := []string{"pipeline", "test.d/merge_bad_template.yaml", "test.d/bad_template.yaml"}
+	if strings.Join(templates, ",") != strings.Join(expected, ",") {
+		t.Errorf("Unexpected merge chain %v", templates)
+	}
+
+	data, err := json.Marshal(pe)
+	if err != nil {
+		t.Fatalf("Error marshalling PipelineError: %v", err)
+	}
+	if !strings.Contains(string(data), `"args":{"flags":[true]}`) {
+		t.Errorf("Expected args in JSON error, got %s", data)
+	}
+}
+
+func TestTransformRelativeResolution(t *testing.T) {
+	p := `
+uav:
+  resolve: relative
+merge:
+- template: jobs/deploy.yaml
+`
+	expectedPipeline := `
+resources:
+- name: repo
+  type: custom
+resource_types:
+- name: custom
+  type: registry-image
+jobs:
+- name: deploy
+  plan:
+  - get: repo
+`
+	pipeline := new(Pipeline)
+	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
+	expected := pipeline.String()
+
+	merger, err := NewPipeline(p, nil, nil, WithPipelineFile("test.d/relative/pipeline.yaml"))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	pipeline, err = merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	result := pipeline.String()
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+
+	merger, _ = NewPipeline(p, nil, nil, WithPipelineFile("test.d/relative/pipeline.yaml"), WithResolution(ResolveWorkingDir))
+	if _, err = merger.Transform(); !errors.Is(err, ErrTemplateNotFound) {
+		t.Errorf("Expected ErrTemplateNotFound when resolving from the working directory, got %v", err)
+	}
+}
+
+func TestTransformDetectsMergeCycles(t *testing.T) {
+	p := `
+merge:
+- template: test.d/cycle/a.yaml
+`
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	_, err = merger.Transform()
+	var ce *MergeCycleError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Expected a MergeCycleError, got %#v", err)
+	}
+	expected := "test.d/cycle/a.yaml -> test.d/cycle/b.yaml -> test.d/cycle/a.yaml"
+	if strings.Join(ce.Templates, " -> ") != expected {
+		t.Errorf("Unexpected cycle %v", ce.Templates)
+	}
+}
+
+func TestTransformMaxMergeDepth(t *testing.T) {
+	p := `
+merge:
+- template: test.d/merge_bad_template.yaml
+`
+	merger, err := NewPipeline(p, nil, nil, WithMaxMergeDepth(1))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	if _, err = merger.Transform(); !errors.Is(err, ErrMaxMergeDepth) {
+		t.Errorf("Expected ErrMaxMergeDepth, got %v", err)
+	}
+}
+
+func TestTransformMergeStrategy(t *testing.T) {
+	p := `
+resources:
+- name: test
+  type: git
+  source:
+    uri: git@github.com:concourse/concourse.git
+    branch: master
+merge:
+- template: test.d/resource_override.yaml
+  strategy: deep-merge
+  args:
+    branch: develop
+`
+	expectedPipeline := `
+resources:
+- name: test
+  type: git
+  source:
+    uri: git@github.com:concourse/concourse.git
+    branch: develop
+`
+	pipeline := new(Pipeline)
+	yaml.Unmarshal([]byte(expectedPipeline), pipeline)
+	expected := pipeline.String()
+
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	pipeline, err = merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	result := pipeline.String()
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+}
+
+func TestTransformDuplicateJobs(t *testing.T) {
+	p := `
+merge:
+- template: test.d/job_simple.yaml
+- template: test.d/job_simple.yaml
+`
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+	if len(pipeline.Jobs) != 1 {
+		t.Errorf("Expected identical jobs to be collapsed, got %d jobs", len(pipeline.Jobs))
+	}
+
+	p = `
+merge:
+- template: test.d/job_simple.yaml
+- template: test.d/job_with_params.yaml
+`
+	merger, err = NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	_, err = merger.Transform()
+	var de *DuplicateError
+	if !errors.As(err, &de) {
+		t.Fatalf("Expected a DuplicateError, got %#v", err)
+	}
+	if de.Kind != kindJob || de.Name != "deploy" || strings.Join(de.Templates, ",") != "test.d/job_simple.yaml,test.d/job_with_params.yaml" {
+		t.Errorf("Unexpected duplicate error %v", de)
+	}
+}
+
+func TestTransformDuplicatesWithinTemplate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"r1.yml": {Data: []byte("resources:\n- name: other\n  type: git\n")},
+	}
+	p := `
+resources:
+- name: r
+  type: git
+- name: r
+  type: s3
+merge:
+- template: r1.yml
+`
+	merger, err := NewPipeline(p, nil, nil, WithFS(fsys), WithPipelineFile("s6.yml"))
+	var de *DuplicateError
+	if !errors.As(err, &de) {
+		t.Fatalf("Expected a DuplicateError, got %#v", err)
+	}
+	if de.Kind != kindResource || de.Name != "r" || strings.Join(de.Templates, ",") != "s6.yml" {
+		t.Errorf("Unexpected duplicate error %v", de)
+	}
+	if err.Error() != `s6.yml: resource "r" is defined more than once, differently, by s6.yml` {
+		t.Errorf("Unexpected error message %q", err)
+	}
+
+	fsys["dup.yml"] = &fstest.MapFile{Data: []byte("jobs:\n- name: j\n  plan: []\n- name: j\n  serial: true\n  plan: []\n")}
+	p = `
+jobs:
+- name: build
+  plan: []
+- name: build
+  plan: []
+merge:
+- template: dup.yml
+  strategy: last-wins
+`
+	merger, err = NewPipeline(p, nil, nil, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	if len(merger.Jobs) != 1 {
+		t.Errorf("Expected identical jobs to be collapsed, got %d jobs", len(merger.Jobs))
+	}
+	_, err = merger.Transform()
+	if !errors.As(err, &de) {
+		t.Fatalf("Expected a DuplicateError, got %#v", err)
+	}
+	if de.Kind != kindJob || de.Name != "j" || strings.Join(de.Templates, ",") != "dup.yml" {
+		t.Errorf("Unexpected duplicate error %v", de)
+	}
+}
+
+func TestTransformExtendJob(t *testing.T) {
+	p := `
+merge:
+- template: test.d/job_simple.yaml
+- template: test.d/job_extend.yaml
+  strategy: extend
+`
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+	if len(pipeline.Jobs) != 1 {
+		t.Fatalf("Expected one job, got %d", len(pipeline.Jobs))
+	}
+
+	steps := sequenceItems(mappingValue(pipeline.Jobs[0], "plan"))
+	if len(steps) != 2 {
+		t.Fatalf("Expected the plan to be extended to 2 steps, got %d", len(steps))
+	}
+	if put, _ := scalarValue(mappingValue(steps[1], "put")); put != "notify" {
+		t.Errorf("Expected the appended step to put notify, got %v", put)
+	}
+	if serial, _ := scalarValue(mappingValue(pipeline.Jobs[0], "serial")); serial != "true" {
+		t.Errorf("Expected the existing job settings to be kept")
+	}
+}
+
+func TestTransformExtendIdenticalDependency(t *testing.T) {
+	repo := `resources:
+- name: repo
+  type: git
+  tags: [linux]
+`
+	fsys := fstest.MapFS{
+		"base.yml": {Data: []byte(repo + "jobs:\n- name: build\n  plan:\n  - get: repo\n")},
+		"ext.yml":  {Data: []byte(repo + "jobs:\n- name: build\n  plan:\n  - put: notify\n")},
+	}
+	tests := []struct {
+		pipeline string
+		expected string
+	}{
+		{
+			pipeline: `
+merge:
+- template: base.yml
+- template: ext.yml
+  strategy: extend
+`,
+			expected: `resources:
+- name: repo
+  type: git
+  tags: [linux]
+jobs:
+- name: build
+  plan:
+  - get: repo
+  - put: notify
+`,
+		},
+		{
+			pipeline: `
+merge:
+- template: base.yml
+- template: base.yml
+  strategy: extend
+`,
+			expected: `resources:
+- name: repo
+  type: git
+  tags: [linux]
+jobs:
+- name: build
+  plan:
+  - get: repo
+`,
+		},
+	}
+
+	for _, test := range tests {
+		merger, err := NewPipeline(test.pipeline, nil, nil, WithFS(fsys))
+		if err != nil {
+			t.Fatalf("Error creating pipeline: %v", err)
+		}
+		pipeline, err := merger.Transform()
+		if err != nil {
+			t.Fatalf("Error transforming %v: %v", test.pipeline, err)
+		}
+		result, err := pipeline.Marshal()
+		if err != nil {
+			t.Fatalf("Error marshalling pipeline: %v", err)
+		}
+		if result != test.expected {
+			t.Errorf("[%v] is not equal to [%v]\n", result, test.expected)
+		}
+	}
+}
+
+func TestTransformKeepsTopLevelComments(t *testing.T) {
+	fsys := fstest.MapFS{
+		"types.yml": {Data: []byte(`# Template header
+
+# Resource types from the template
+resource_types:
+- name: slack
+  type: registry-image
+jobs:
+- name: notify
+  plan: []
+`)},
+	}
+	p := `# Pipeline for app
+
+# Resources here
+resources: # all of them
+- name: repo
+  type: git
+
+# Jobs below
+jobs:
+- name: build # first job
+  plan: []
+merge:
+- template: types.yml
+
+# End of pipeline
+`
+	expected := `# Pipeline for app
+
+# Resources here
+resources: # all of them
+- name: repo
+  type: git
+# Resource types from the template
+resource_types:
+- name: slack
+  type: registry-image
+# Jobs below
+jobs:
+- name: build # first job
+  plan: []
+- name: notify
+  plan: []
+
+# End of pipeline
+`
+	merger, err := NewPipeline(p, nil, nil, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+	out, err := pipeline.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling pipeline: %v", err)
+	}
+	if out != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestTransformVarSourcesAndDisplay(t *testing.T) {
+	p := `
+var_sources:
+- name: vault
+  type: vault
+  config:
+    url: https://vault.example.com
+merge:
+- template: test.d/var_sources.yaml
+  args:
+    image: background.png
+`
+	expected := `var_sources:
+- name: vault
+  type: vault
+  config:
+    url: https://vault.example.com
+display:
+  background_image: https://example.com/background.png
+`
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	result := pipeline.String()
+	if result != expected {
+		t.Errorf("[%v] is not equal to [%v]\n", result, expected)
+	}
+
+	p = `
+display:
+  background_image: https://example.com/other.png
+merge:
+- template: test.d/var_sources.yaml
+  args:
+    image: background.png
+`
+	merger, err = NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	_, err = merger.Transform()
+	var de *DuplicateError
+	if !errors.As(err, &de) || de.Kind != kindDisplay {
+		t.Errorf("Expected a DuplicateError for display, got %#v", err)
+	}
+}
+
+func TestTransformUnknownKeys(t *testing.T) {
+	p := `
+merge:
+- template: test.d/unknown_key.yaml
+`
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+	warnings := pipeline.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `test.d/unknown_key.yaml:1: unknown top-level key "common"`) {
+		t.Errorf("Unexpected warnings %v", warnings)
+	}
+	if serial, _ := scalarValue(mappingValue(pipeline.Jobs[0], "serial")); serial != "true" {
+		t.Errorf("Expected anchors under unknown keys to still be usable")
+	}
+
+	merger, err = NewPipeline(p, nil, nil, WithStrictKeys(true))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	_, err = merger.Transform()
+	var pe *PipelineError
+	if !errors.As(err, &pe) || pe.File != "test.d/unknown_key.yaml" || pe.Line != 1 {
+		t.Errorf("Expected an unknown key error at test.d/unknown_key.yaml:1, got %v", err)
+	}
+}
+
+func TestTransformEnv(t *testing.T) {
+	t.Setenv("UAV_ENV", "qa")
+	t.Setenv("UAV_TEST_SECRET", "hunter2")
+
+	p := `
+merge:
+- template: test.d/env.yaml
+jobs:
+- name: {{ env "UAV_ENV" }}-{{ .Env.UAV_TEST_SECRET | len }}
+  plan: []
+`
+	merger, err := NewPipeline(p, nil, nil, WithEnv([]string{"UAV_"}, nil))
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	var names []string
+	for _, job := range pipeline.Jobs {
+		name, _ := getName(job)
+		names = append(names, name)
+	}
+	if strings.Join(names, ",") != "qa-7,deploy-qa" {
+		t.Errorf("Unexpected jobs %v", names)
+	}
+
+	tests := []string{
+		`{{ env "HOME" }}`,
+		`{{ expandenv "$UAV_ENV/$HOME" }}`,
+		`{{ .Env.HOME }}`,
+	}
+	for _, test := range tests {
+		_, err := NewPipeline(test, nil, nil, WithEnv(nil, []string{"UAV_ENV"}))
+		var te *TemplateError
+		if !errors.As(err, &te) || !errors.Is(err, ErrEnvNotAllowed) || !strings.HasSuffix(err.Error(), ": HOME") {
+			t.Errorf("%s: expected an ErrEnvNotAllowed TemplateError, got %v", test, err)
+		}
 	}
 }
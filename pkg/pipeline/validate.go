@@ -0,0 +1,242 @@
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// builtinResourceTypes are the resource types Concourse provides without a
+// `resource_types` declaration.
+var builtinResourceTypes = map[string]bool{
+	"bosh-io-release":  true,
+	"bosh-io-stemcell": true,
+	"cf":               true,
+	"docker-image":     true,
+	"git":              true,
+	"github-release":   true,
+	"hg":               true,
+	"mock":             true,
+	"pool":             true,
+	"registry-image":   true,
+	"s3":               true,
+	"semver":           true,
+	"time":             true,
+	"tracker":          true,
+}
+
+// stepHooks are the keys under which a step or job nests a further step.
+var stepHooks = []string{"on_success", "on_failure", "on_abort", "on_error", "ensure", "try"}
+
+// ValidationError is a dangling reference found by Validate. Kind and Name
+// identify the object containing the reference, and Chain the merge entries,
+// root pipeline first, that introduced that object.
+type ValidationError struct {
+	Kind    string       `json:"kind"`
+	Name    string       `json:"name"`
+	Message string       `json:"message"`
+	Chain   []MergeFrame `json:"chain"`
+}
+
+// Template returns the template which introduced the object in error.
+func (e ValidationError) Template() string {
+	if len(e.Chain) == 0 {
+		return ""
+	}
+	return e.Chain[len(e.Chain)-1].Template
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s %s: %s", e.Template(), strings.Replace(e.Kind, "_", " ", -1), e.Name, e.Message)
+}
+
+// Validate checks the referential integrity of a transformed pipeline: that
+// every resource a job step uses is declared, every `passed:` constraint
+// names a job, every resource type is built-in or declared, and every group
+// lists existing jobs. It returns a ValidationError for each dangling
+// reference, in pipeline order.
+func (p *Pipeline) Validate() []ValidationError {
+	v := validator{pipeline: p}
+	v.jobs = v.names(p.Jobs)
+	v.resources = v.names(p.Resources)
+	v.resourceTypes = v.names(p.ResourceTypes)
+
+	for _, job := range p.Jobs {
+		v.validateJob(job)
+	}
+	for _, resource := range p.Resources {
+		v.validateType(kindResource, resource)
+	}
+	for _, resourceType := range p.ResourceTypes {
+		v.validateType(kindResourceType, resourceType)
+	}
+	for _, group := range p.Groups {
+		v.validateGroup(group)
+	}
+
+	return v.errors
+}
+
+type validator struct {
+	pipeline      *Pipeline
+	jobs          map[string]bool
+	resources     map[string]bool
+	resourceTypes map[string]bool
+	errors        []ValidationError
+}
+
+func (v *validator) names(items []*yaml.Node) map[string]bool {
+	names := make(map[string]bool, len(items))
+	for _, item := range items {
+		if name, err := getName(item); err == nil {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func (v *validator) report(kind string, name string, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{
+		Kind:    kind,
+		Name:    name,
+		Message: fmt.Sprintf(format, args...),
+		Chain:   v.pipeline.origin(kind, name).chain(),
+	})
+}
+
+func (v *validator) validateJob(job *yaml.Node) {
+	name, err := getName(job)
+	if err != nil {
+		return
+	}
+
+	forEachStep(job, func(step *yaml.Node) {
+		v.validateStep(name, step)
+	})
+}
+
+// forEachStep calls fn for every step of a job: those of its plan and hooks,
+// and those nested within them.
+func forEachStep(job *yaml.Node, fn func(step *yaml.Node)) {
+	walkSteps(sequenceItems(mappingValue(job, "plan")), fn)
+	for _, hook := range stepHooks {
+		if step := mappingValue(job, hook); step != nil {
+			walkStep(step, fn)
+		}
+	}
+}
+
+func walkSteps(steps []*yaml.Node, fn func(step *yaml.Node)) {
+	for _, step := range steps {
+		walkStep(step, fn)
+	}
+}
+
+func walkStep(step *yaml.Node, fn func(step *yaml.Node)) {
+	if step == nil || step.Kind != yaml.MappingNode {
+		return
+	}
+
+	fn(step)
+	for _, key := range []string{"do", "aggregate"} {
+		walkSteps(sequenceItems(mappingValue(step, key)), fn)
+	}
+	if inParallel := mappingValue(step, "in_parallel"); inParallel != nil {
+		if inParallel.Kind == yaml.SequenceNode {
+			walkSteps(inParallel.Content, fn)
+		} else {
+			walkSteps(sequenceItems(mappingValue(inParallel, "steps")), fn)
+		}
+	}
+	for _, hook := range stepHooks {
+		if nested := mappingValue(step, hook); nested != nil {
+			walkStep(nested, fn)
+		}
+	}
+}
+
+// stepResource returns the action (get or put) of a step, and the name it is
+// known by in the plan and the resource it uses, which may differ.
+func stepResource(step *yaml.Node) (action string, alias string, resource string, ok bool) {
+	for _, action := range []string{"get", "put"} {
+		alias, ok := scalarValue(mappingValue(step, action))
+		if !ok {
+			continue
+		}
+		resource := alias
+		if r, ok := scalarValue(mappingValue(step, "resource")); ok {
+			resource = r
+		}
+		return action, alias, resource, true
+	}
+	return "", "", "", false
+}
+
+// validateStep checks the resources and jobs referred to by a single step of
+// job.
+func (v *validator) validateStep(job string, step *yaml.Node) {
+	action, alias, resource, ok := stepResource(step)
+	if !ok {
+		return
+	}
+
+	if !v.resources[resource] {
+		v.report(kindJob, job, "%s: unknown resource %q", action, resource)
+	}
+	for _, passed := range sequenceItems(mappingValue(step, "passed")) {
+		if passedJob, ok := scalarValue(passed); ok && !v.jobs[passedJob] {
+			v.report(kindJob, job, "%s %s: passed: unknown job %q", action, alias, passedJob)
+		}
+	}
+}
+
+// validateType checks that a resource or resource type has a known type.
+func (v *validator) validateType(kind string, item *yaml.Node) {
+	name, err := getName(item)
+	if err != nil {
+		return
+	}
+
+	t, ok := scalarValue(mappingValue(item, "type"))
+	if !ok {
+		v.report(kind, name, "missing type")
+		return
+	}
+	if builtinResourceTypes[t] || (v.resourceTypes[t] && !(kind == kindResourceType && t == name)) {
+		return
+	}
+	v.report(kind, name, "unknown resource type %q", t)
+}
+
+func (v *validator) validateGroup(group *yaml.Node) {
+	name, err := getName(group)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range sequenceItems(mappingValue(group, "jobs")) {
+		pattern, ok := scalarValue(entry)
+		if !ok {
+			continue
+		}
+		if !v.matchesJob(pattern) {
+			v.report(kindGroup, name, "unknown job %q", pattern)
+		}
+	}
+}
+
+// matchesJob reports whether a group entry, which may be a glob, names at
+// least one job.
+func (v *validator) matchesJob(pattern string) bool {
+	if v.jobs[pattern] {
+		return true
+	}
+	for job := range v.jobs {
+		if ok, _ := path.Match(pattern, job); ok {
+			return true
+		}
+	}
+	return false
+}
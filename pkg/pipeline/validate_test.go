@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"testing"
+)
+
+func TestValidateReportsDanglingReferences(t *testing.T) {
+	p := `
+resource_types:
+- name: slack-notification
+  type: registry-image
+resources:
+- name: repo
+  type: git
+- name: alert
+  type: slack-notification
+- name: version
+  type: custom-semver
+jobs:
+- name: build
+  plan:
+  - in_parallel:
+      steps:
+      - get: repo
+      - get: source
+        resource: repo
+  - put: artifacts
+  on_failure:
+    put: alert
+- name: deploy
+  plan:
+  - get: repo
+    passed: [build, test]
+  - try:
+      do:
+      - put: alert
+      - put: pager
+groups:
+- name: all
+  jobs: [build, deploy, unit, "b*"]
+merge:
+- template: test.d/job_dangling.yaml
+`
+	merger, err := NewPipeline(p, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pipeline: %v", err)
+	}
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	expected := []string{
+		`pipeline: job build: put: unknown resource "artifacts"`,
+		`pipeline: job deploy: get repo: passed: unknown job "test"`,
+		`pipeline: job deploy: put: unknown resource "pager"`,
+		`test.d/job_dangling.yaml: job unit: get: unknown resource "missing-repo"`,
+		`pipeline: resource version: unknown resource type "custom-semver"`,
+	}
+
+	problems := pipeline.Validate()
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, problem := range problems {
+		if problem.Error() != expected[i] {
+			t.Errorf("[%v] is not equal to [%v]", problem.Error(), expected[i])
+		}
+	}
+}
+
+func TestValidateValidPipeline(t *testing.T) {
+	p := `
+merge:
+- template: test.d/resource_with_type.yaml
+jobs:
+- name: notify
+  plan:
+  - put: slack-alert
+`
+	merger, _ := NewPipeline(p, nil, nil)
+	pipeline, err := merger.Transform()
+	if err != nil {
+		t.Fatalf("Error transforming %v: %v", p, err)
+	}
+
+	if problems := pipeline.Validate(); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
@@ -0,0 +1,45 @@
+package uav
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// combineTemplates returns a slice which is the superset of the templates slice and the file paths of
+// all files contained in directories rooted at the directories specified in the templateDirs slice
+func combineTemplates(fsys fs.FS, templates []string, templateDirs []string) ([]string, error) {
+	directoryTemplates, err := getDirectoryTemplates(fsys, templateDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]string{}, templates...), directoryTemplates...), nil
+}
+
+// getDirectoryTemplates recurses through the directory tree rooted at each element of slice templateDirs
+// and adds each file path to the returned slice
+func getDirectoryTemplates(fsys fs.FS, templateDirs []string) ([]string, error) {
+	var templateFiles []string
+
+	// Callback function called when each directory entry is visited by the walker
+	walkFunc := func(currentPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("reading file %s: %v", currentPath, err)
+		}
+
+		if !entry.IsDir() {
+			templateFiles = append(templateFiles, currentPath)
+		}
+
+		return nil
+	}
+
+	for _, templateDir := range templateDirs {
+		err := fs.WalkDir(fsys, templateDir, walkFunc)
+		if err != nil {
+			return nil, fmt.Errorf("recursing directory tree rooted at %s: %v", templateDir, err)
+		}
+	}
+
+	return templateFiles, nil
+}
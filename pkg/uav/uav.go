@@ -0,0 +1,190 @@
+// Package uav renders Concourse pipelines from UAV pipeline templates, as the
+// uav command does, for programs which embed it rather than running the
+// binary.
+//
+// A Renderer is configured once with functional options and can then render
+// any number of pipelines:
+//
+//	r := uav.NewRenderer(
+//		uav.WithTemplateDirs("templates"),
+//		uav.WithVars(map[string]interface{}{"env": "qa"}),
+//	)
+//	pl, err := r.RenderFile("my.pipeline.yaml")
+//	if err != nil {
+//		return err
+//	}
+//	out, err := pl.Marshal()
+//
+// Options not covered here, such as environment variable allow-lists or
+// generated groups, are passed through to package pipeline with
+// WithPipelineOptions.
+package uav
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"text/template"
+
+	"github.com/finbourne/uav/pkg/pipeline"
+)
+
+// Renderer renders pipelines with a fixed set of templates and options. It
+// is safe for concurrent use.
+type Renderer struct {
+	templates    []string
+	templateDirs []string
+	vars         map[string]interface{}
+	fsys         fs.FS
+	opts         []pipeline.Option
+}
+
+// Option configures a Renderer.
+type Option func(*Renderer)
+
+// NewRenderer returns a Renderer configured with opts.
+func NewRenderer(opts ...Option) *Renderer {
+	r := &Renderer{}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// WithTemplates makes the given template files available to pipelines, for
+// use by `{{ template }}`, `{{ include }}` and `merge:` entries.
+func WithTemplates(files ...string) Option {
+	return func(r *Renderer) {
+		r.templates = append(r.templates, files...)
+	}
+}
+
+// WithTemplateDirs makes every file under the given directories available to
+// pipelines as a template, by its basename or its path relative to the
+// directory.
+func WithTemplateDirs(dirs ...string) Option {
+	return func(r *Renderer) {
+		r.templateDirs = append(r.templateDirs, dirs...)
+	}
+}
+
+// WithVars sets the arguments the root pipeline template is rendered with.
+// Later calls override the values of earlier ones.
+func WithVars(vars map[string]interface{}) Option {
+	return func(r *Renderer) {
+		if r.vars == nil {
+			r.vars = map[string]interface{}{}
+		}
+		for k, v := range vars {
+			r.vars[k] = v
+		}
+	}
+}
+
+// WithFS reads the pipeline, template files and template directories from
+// fsys rather than the operating system's file system, e.g. from an embed.FS
+// or an fstest.MapFS. Paths are then slash-separated and relative to the root
+// of fsys.
+func WithFS(fsys fs.FS) Option {
+	return func(r *Renderer) {
+		r.fsys = fsys
+		r.opts = append(r.opts, pipeline.WithFS(fsys))
+	}
+}
+
+// fileSystem returns the file system set with WithFS, or pipeline.OSFS.
+func (r *Renderer) fileSystem() fs.FS {
+	if r.fsys == nil {
+		return pipeline.OSFS
+	}
+	return r.fsys
+}
+
+// WithResolution sets how `merge:` template paths are resolved.
+func WithResolution(resolution pipeline.Resolution) Option {
+	return WithPipelineOptions(pipeline.WithResolution(resolution))
+}
+
+// WithStrategy sets the strategy used by `merge:` entries which do not set
+// one themselves.
+func WithStrategy(s pipeline.Strategy) Option {
+	return WithPipelineOptions(pipeline.WithDefaultStrategy(s))
+}
+
+// WithFuncs makes funcs available to every template.
+func WithFuncs(funcs template.FuncMap) Option {
+	return WithPipelineOptions(pipeline.WithFuncs(funcs))
+}
+
+// WithLogger sends the messages logged while rendering to l.
+func WithLogger(l pipeline.Logger) Option {
+	return WithPipelineOptions(pipeline.WithLogger(l))
+}
+
+// WithJobs renders up to n `merge:` templates at once. The result is the same
+// whatever n is, but funcs passed with WithFuncs must be safe for concurrent
+// use.
+func WithJobs(n int) Option {
+	return WithPipelineOptions(pipeline.WithJobs(n))
+}
+
+// WithPipelineOptions passes opts through to pipeline.NewPipeline.
+func WithPipelineOptions(opts ...pipeline.Option) Option {
+	return func(r *Renderer) {
+		r.opts = append(r.opts, opts...)
+	}
+}
+
+// RenderFile reads the pipeline template in file and renders it. Errors and
+// relative `merge:` paths refer to the pipeline by the file's name.
+func (r *Renderer) RenderFile(file string, opts ...pipeline.Option) (*pipeline.Pipeline, error) {
+	return r.RenderFileContext(context.Background(), file, opts...)
+}
+
+// RenderFileContext is RenderFile, giving up with an error naming the
+// template being rendered if ctx is done first.
+func (r *Renderer) RenderFileContext(ctx context.Context, file string, opts ...pipeline.Option) (*pipeline.Pipeline, error) {
+	input, err := fs.ReadFile(r.fileSystem(), file)
+	if err != nil {
+		return nil, fmt.Errorf("reading pipeline file: %v", err)
+	}
+	return r.RenderContext(ctx, string(input), append([]pipeline.Option{pipeline.WithPipelineFile(file)}, opts...)...)
+}
+
+// Render renders the pipeline template text: it is rendered with the
+// Renderer's vars and its `merge:` entries merged into it, recursively. opts
+// apply to this pipeline only, after the Renderer's own.
+func (r *Renderer) Render(text string, opts ...pipeline.Option) (*pipeline.Pipeline, error) {
+	return r.RenderContext(context.Background(), text, opts...)
+}
+
+// RenderContext is Render, giving up with an error naming the template being
+// rendered if ctx is done first. The error wraps ctx.Err(), so
+// errors.Is(err, context.DeadlineExceeded) reports a timeout.
+//
+// A template looping without writing output or calling `include`, `until`,
+// `untilStep` or a function given to WithFuncs cannot be interrupted, and
+// runs on in the background until it finishes after RenderContext has
+// returned. Services rendering untrusted templates should bound such loops
+// themselves, or render in a separate process.
+func (r *Renderer) RenderContext(ctx context.Context, text string, opts ...pipeline.Option) (*pipeline.Pipeline, error) {
+	templates := r.templates
+	if len(r.templateDirs) > 0 {
+		var err error
+		templates, err = combineTemplates(r.fileSystem(), templates, r.templateDirs)
+		if err != nil {
+			return nil, fmt.Errorf("combining template files and template directories: %v", err)
+		}
+	}
+
+	all := make([]pipeline.Option, 0, len(r.opts)+len(opts)+1)
+	all = append(all, r.opts...)
+	all = append(all, opts...)
+	all = append(all, pipeline.WithTemplateRoots(r.templateDirs...))
+	pl, err := pipeline.NewPipelineContext(ctx, text, r.vars, templates, all...)
+	if err != nil {
+		return nil, fmt.Errorf("transforming pipeline file: %w", err)
+	}
+
+	return pl.TransformContext(ctx)
+}
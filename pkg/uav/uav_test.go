@@ -0,0 +1,126 @@
+package uav
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+
+	"github.com/finbourne/uav/pkg/pipeline"
+)
+
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func TestRenderFile(t *testing.T) {
+	expected := `resources:
+- name: repo
+  type: git
+  source:
+    uri: https://github.com/platform/app.git
+jobs:
+- name: build
+  plan:
+  - get: repo
+  - task: BUILD
+    file: repo/ci/build.yml
+`
+	logger := &recordingLogger{}
+	r := NewRenderer(
+		WithTemplateDirs("testdata/templates"),
+		WithVars(map[string]interface{}{"team": "platform"}),
+		WithFuncs(template.FuncMap{"shout": strings.ToUpper}),
+		WithLogger(logger),
+	)
+
+	pl, err := r.RenderFile("testdata/pipeline.yml")
+	if err != nil {
+		t.Fatalf("Error rendering pipeline: %v", err)
+	}
+	out, err := pl.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling pipeline: %v", err)
+	}
+	if out != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out)
+	}
+	if len(logger.messages) == 0 {
+		t.Errorf("Expected messages to be sent to the logger")
+	}
+}
+
+func TestRenderStrategy(t *testing.T) {
+	p := `
+jobs:
+- name: build
+  plan: []
+merge:
+- template: job.yml
+  args:
+    name: build
+`
+	r := NewRenderer(
+		WithTemplates("testdata/templates/job.yml"),
+		WithFuncs(template.FuncMap{"shout": strings.ToUpper}),
+	)
+	if _, err := r.Render(p); err == nil {
+		t.Fatalf("Expected conflicting jobs to fail without a strategy")
+	}
+
+	r = NewRenderer(
+		WithTemplates("testdata/templates/job.yml"),
+		WithFuncs(template.FuncMap{"shout": strings.ToUpper}),
+		WithStrategy(pipeline.StrategyFirstWins),
+	)
+	pl, err := r.Render(p)
+	if err != nil {
+		t.Fatalf("Error rendering pipeline: %v", err)
+	}
+	if len(pl.Jobs) != 1 || len(pl.Jobs[0].Content) != 4 || len(pl.Jobs[0].Content[3].Content) != 0 {
+		t.Errorf("Expected the pipeline's own job to be kept, got:\n%s", pl)
+	}
+}
+
+func TestRenderFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"pipeline.yml":          {Data: []byte("merge:\n- template: job.yml\n  args:\n    name: test\n")},
+		"templates/ci/job.yml":  {Data: []byte("jobs:\n- name: {{ .name }}\n  plan: []\n")},
+		"templates/ci/other.md": {Data: []byte("not a template")},
+	}
+	expected := `jobs:
+- name: test
+  plan: []
+`
+	r := NewRenderer(WithFS(fsys), WithTemplateDirs("templates"))
+	pl, err := r.RenderFile("pipeline.yml")
+	if err != nil {
+		t.Fatalf("Error rendering pipeline: %v", err)
+	}
+	out, err := pl.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling pipeline: %v", err)
+	}
+	if out != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestGetDirectoryTemplates(t *testing.T) {
+	templates, err := combineTemplates(pipeline.OSFS, []string{"testdata/pipeline.yml"}, []string{"testdata/templates"})
+	if err != nil {
+		t.Fatalf("Error combining templates: %v", err)
+	}
+	if strings.Join(templates, ",") != "testdata/pipeline.yml,testdata/templates/job.yml" {
+		t.Errorf("Unexpected templates %v", templates)
+	}
+}
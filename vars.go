@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	yaml "go.yaml.in/yaml/v3"
+)
+
+// loadVars builds the args the root pipeline is rendered with. Each file is
+// a YAML map whose keys override those of the files before it; jsonVars
+// (key=<json>) and then vars (key=value) override the files.
+func loadVars(files []string, jsonVars []string, vars []string) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("--vars-file %s: %v", file, err)
+		}
+		var values map[string]interface{}
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("--vars-file %s: should be a YAML map: %v", file, err)
+		}
+		for k, v := range values {
+			args[k] = v
+		}
+	}
+
+	for _, v := range jsonVars {
+		key, value, err := splitVar("--var-json", v)
+		if err != nil {
+			return nil, err
+		}
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+			return nil, fmt.Errorf("--var-json %s: invalid JSON: %v", key, err)
+		}
+		args[key] = decoded
+	}
+
+	for _, v := range vars {
+		key, value, err := splitVar("--var", v)
+		if err != nil {
+			return nil, err
+		}
+		args[key] = value
+	}
+
+	return args, nil
+}
+
+func splitVar(flag string, v string) (string, string, error) {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || strings.TrimSpace(key) == "" {
+		return "", "", fmt.Errorf("%s %q: expected key=value", flag, v)
+	}
+	return key, value, nil
+}
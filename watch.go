@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/finbourne/uav/pkg/pipeline"
+)
+
+// watchPipeline merges the pipeline selected by f to output, and merges it
+// again whenever the pipeline file, a template, a vars file or a file under
+// one of the template directories changes. Failures are reported without
+// stopping.
+func watchPipeline(f *renderFlags, output string, interval time.Duration, debounce time.Duration) {
+	destination := output
+	if destination == "" || destination == "-" {
+		destination = "stdout"
+	}
+
+	w := &watcher{
+		interval: interval,
+		debounce: debounce,
+		dirs:     *f.templateDirs,
+		render: func() ([]string, error) {
+			files := []string{(*f.pipelineFile).Name()}
+			files = append(files, *f.templates...)
+			files = append(files, *f.varsFiles...)
+
+			pl, err := f.render(pipeline.WithReadObserver(func(path string) {
+				files = append(files, path)
+			}))
+			if err != nil {
+				return files, err
+			}
+			text, err := pl.Marshal()
+			if err != nil {
+				return files, err
+			}
+			return files, writeOutput(output, text)
+		},
+		report: func(err error) {
+			now := time.Now().Format("15:04:05")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s error: %v\n", now, err)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "%s merged to %s\n", now, destination)
+		},
+	}
+	w.run(nil)
+}
+
+// watcher re-renders a pipeline whenever one of the files it was rendered
+// from changes. Files are polled rather than watched through the operating
+// system, so that editors which replace files on save, and network file
+// systems, behave the same.
+type watcher struct {
+	interval time.Duration
+	debounce time.Duration
+	// dirs are walked on every poll, so that new templates are noticed.
+	dirs []string
+	// render renders the pipeline, returning the files it read, whether or
+	// not it succeeded.
+	render func() ([]string, error)
+	// report is called after each render with its result.
+	report func(err error)
+}
+
+// fileState is what a poll records about a file. A missing file has the zero
+// value.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// run renders the pipeline and then re-renders it each time the files change
+// and stay unchanged for the debounce period, until stop is closed.
+func (w *watcher) run(stop <-chan struct{}) {
+	files, err := w.render()
+	w.report(err)
+	last := w.snapshot(files)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var changedAt time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := w.snapshot(files)
+		if !sameSnapshot(last, current) {
+			last = current
+			changedAt = time.Now()
+			continue
+		}
+		if changedAt.IsZero() || time.Since(changedAt) < w.debounce {
+			continue
+		}
+
+		changedAt = time.Time{}
+		rendered, err := w.render()
+		w.report(err)
+		files = mergeFileLists(files, rendered)
+		last = w.snapshot(files)
+	}
+}
+
+// snapshot records the state of files and of every file under the watched
+// directories.
+func (w *watcher) snapshot(files []string) map[string]fileState {
+	states := make(map[string]fileState, len(files))
+	for _, f := range files {
+		states[f] = statFile(f)
+	}
+	for _, dir := range w.dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				states[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+			}
+			return nil
+		})
+	}
+	return states
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}
+}
+
+func sameSnapshot(a map[string]fileState, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		if other, ok := b[path]; !ok || other != state {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeFileLists returns the files in either list, sorted. Files read by an
+// earlier render are kept so that a render which fails part way through
+// still notices changes to the files it did not reach.
+func mergeFileLists(a []string, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var out []string
+	for _, f := range append(append([]string{}, a...), b...) {
+		if !seen[f] {
+			seen[f] = true
+			out = append(out, f)
+		}
+	}
+	sort.Strings(out)
+	return out
+}